@@ -2,10 +2,8 @@ package main
 
 import (
 	"bufio"
-	"flag"
 	"fmt"
 	plugin "github.com/gorpher/go-idpc-plugin"
-	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"net"
 	"os"
@@ -100,11 +98,10 @@ func (m MemcachedPlugin) Meta() plugin.Meta {
 	if m.Key == "" {
 		m.Key = "memcached"
 	}
-	version, _ := plugin.ParseVersion(Version)
 	return plugin.Meta{
 		Key:       m.Key,
 		Type:      plugin.TypeMetrics,
-		Version:   version,
+		Version:   plugin.MustParseVersion(Version),
 		Revision:  Revision,
 		GOARCH:    GOARCH,
 		GOOS:      GOOS,
@@ -147,25 +144,21 @@ func (m MemcachedPlugin) GraphDefinition() map[string]plugin.Graphs {
 }
 
 func main() {
-	optHost := flag.String("host", "localhost", "Hostname")
-	optPort := flag.String("port", "11211", "Port")
-	optTempFile := flag.String("tempFile", "", "Temp file name")
-	v := flag.Bool("v", false, "version")
-	if os.Getenv(plugin.PLUGIN_PREFIX+"DEBUG") != "" {
-		log.Logger.Level(zerolog.DebugLevel)
-	} else {
-		log.Logger.Level(zerolog.FatalLevel)
-	}
-	flag.Parse()
-
 	var memcached MemcachedPlugin
+	flags := plugin.NewFlagSet(memcached.Meta())
+	graphs := flags.String("graphs", "", "Comma separated graph keys to output (default all)")
+	flags.Parse(os.Args[1:])
+	if flags.Arg(0) == "validate-graphdef" {
+		if err := plugin.ValidateGraphDefReader(os.Stdin, os.Stdout); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
 
-	memcached.Target = fmt.Sprintf("%s:%s", *optHost, *optPort)
+	memcached.Target = flags.Addr("11211")
 	helper := plugin.NewIdpcPlugin(memcached)
-	helper.TempFile = *optTempFile
-	if *v {
-		fmt.Println(helper.Version())
-		return
+	if *graphs != "" {
+		helper.SelectGraphs = strings.Split(*graphs, ",")
 	}
-	helper.Run()
+	flags.Run(&helper)
 }
@@ -0,0 +1,57 @@
+package plugin
+
+import "math"
+
+// AggFunc 将多个来源的同名指标值聚合为一个值，values 至少包含一个元素
+type AggFunc func(values []float64) float64
+
+var (
+	// AggSum 求和
+	AggSum AggFunc = func(values []float64) float64 {
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum
+	}
+	// AggAvg 求平均值
+	AggAvg AggFunc = func(values []float64) float64 {
+		return AggSum(values) / float64(len(values))
+	}
+	// AggMax 求最大值
+	AggMax AggFunc = func(values []float64) float64 {
+		max := math.Inf(-1)
+		for _, v := range values {
+			max = math.Max(max, v)
+		}
+		return max
+	}
+	// AggMin 求最小值
+	AggMin AggFunc = func(values []float64) float64 {
+		min := math.Inf(1)
+		for _, v := range values {
+			min = math.Min(min, v)
+		}
+		return min
+	}
+)
+
+// AggregateValues 聚合从多个副本采集的指标，每个指标使用agg中同名的聚合函数，
+// agg中没有的指标使用 AggSum。只聚合存在该指标的map，结果均为float64
+func AggregateValues(maps []map[string]interface{}, agg map[string]AggFunc) map[string]interface{} {
+	values := make(map[string][]float64)
+	for _, m := range maps {
+		for k, v := range m {
+			values[k] = append(values[k], toFloat64(v))
+		}
+	}
+	result := make(map[string]interface{}, len(values))
+	for k, vs := range values {
+		f, ok := agg[k]
+		if !ok {
+			f = AggSum
+		}
+		result[k] = f(vs)
+	}
+	return result
+}
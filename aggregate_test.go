@@ -0,0 +1,23 @@
+package plugin
+
+import (
+	"testing"
+)
+
+func TestAggregateValues(t *testing.T) {
+	maps := []map[string]interface{}{
+		{"sum": uint64(1), "avg": 2.0, "max": uint32(3), "min": "4", "default": 1.0},
+		{"sum": uint64(10), "avg": 4.0, "max": uint32(30), "min": "-4", "default": 2.0},
+		{"sum": uint64(100), "avg": 9.0, "max": uint32(5), "min": "0"},
+	}
+	agg := map[string]AggFunc{"sum": AggSum, "avg": AggAvg, "max": AggMax, "min": AggMin}
+	got := AggregateValues(maps, agg)
+	for k, want := range map[string]float64{"sum": 111, "avg": 5, "max": 30, "min": -4, "default": 3} {
+		if got[k] != want {
+			t.Errorf("%s: got %v, want %v", k, got[k], want)
+		}
+	}
+	if len(got) != 5 {
+		t.Errorf("unexpected result %v", got)
+	}
+}
@@ -0,0 +1,36 @@
+package plugin
+
+import "time"
+
+// canBackfill 判断上次在last保存的状态是否可以在now回填
+func (h *IdpcPlugin) canBackfill(last, now time.Time) bool {
+	if last.IsZero() {
+		return false
+	}
+	maxAge := h.BackfillMaxAge
+	if maxAge == 0 {
+		maxAge = 2 * h.maxDiffDuration()
+	}
+	if maxAge > 0 && now.Sub(last) > maxAge {
+		h.logger().Debug().Msgf("BackfillGauges: the state saved at %s is too old, skipped", last)
+		return false
+	}
+	return true
+}
+
+// backfillLines 返回上次状态中保存的非Diff指标值，时间为状态保存时的时间，
+// 这些值的丢弃不计入 Dropped。通配符指标匹配上次状态中的key，而不是本次采集的key
+func (h *IdpcPlugin) backfillLines(key string, graph Graphs, last PluginValues) []MetricLine {
+	dropped, index := h.dropped, h.wildcardIndex
+	h.dropped, h.wildcardIndex = nil, nil
+	defer func() { h.dropped, h.wildcardIndex = dropped, index }()
+
+	var lines []MetricLine
+	for _, metric := range graph.Metrics {
+		if metric.Diff || metric.EmitBoth {
+			continue
+		}
+		lines = append(lines, h.formatMetric(key, percentMetric(graph, metric), last, PluginValues{})...)
+	}
+	return lines
+}
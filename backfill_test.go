@@ -0,0 +1,166 @@
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackfillGauges(t *testing.T) {
+	values := map[string]interface{}{"gauge": 5.0, "counter": 100.0}
+	p := testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"": {Metrics: []Metrics{{Name: "gauge"}, {Name: "counter", Diff: true}}}},
+		values: values,
+	}
+	tempFile := filepath.Join(t.TempDir(), "state")
+	h := NewIdpcPlugin(p)
+	h.TempFile = tempFile
+	advance := testClock(&h)
+	if err := h.writeMetricsValues(io.Discard, p); err != nil {
+		t.Fatal(err)
+	}
+	advance(time.Minute)
+	last, err := h.LoadLastValues()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cold start: a new process with the saved state
+	values["gauge"] = 7.0
+	values["counter"] = 160.0
+	clock := h.Clock
+	h = NewIdpcPlugin(p)
+	h.TempFile = tempFile
+	h.Clock = clock
+	h.BackfillGauges = true
+	out := &bytes.Buffer{}
+	if err := h.writeMetricsValues(out, p); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("test.gauge\t5.000000\t%d\n", last.Timestamp.Unix())
+	if !bytes.HasPrefix(out.Bytes(), []byte(want)) {
+		t.Errorf("expected the saved gauge first, got %q", out.String())
+	}
+	if n := bytes.Count(out.Bytes(), []byte("\n")); n != 3 {
+		t.Errorf("expected the backfilled gauge and 2 fresh values, got %q", out.String())
+	}
+
+	// only the first collection of a process is backfilled
+	advance(time.Minute)
+	out.Reset()
+	if err := h.writeMetricsValues(out, p); err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(out.Bytes(), []byte("\n")); n != 2 {
+		t.Errorf("unexpected output on the second run: %q", out.String())
+	}
+}
+
+func TestBackfillWildcard(t *testing.T) {
+	values := map[string]interface{}{"disk.sda.used": 1.0, "disk.sdb.used": 2.0}
+	p := testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"disk": {Metrics: []Metrics{{Name: "*.used"}}}},
+		values: values,
+	}
+	tempFile := filepath.Join(t.TempDir(), "state")
+	h := NewIdpcPlugin(p)
+	h.TempFile = tempFile
+	advance := testClock(&h)
+	if err := h.writeMetricsValues(io.Discard, p); err != nil {
+		t.Fatal(err)
+	}
+	saved := h.now().Unix()
+	advance(time.Minute)
+
+	// sdb disappeared while the process was down, it is still backfilled from the saved keys
+	delete(values, "disk.sdb.used")
+	values["disk.sdc.used"] = 3.0
+	clock := h.Clock
+	h = NewIdpcPlugin(p)
+	h.TempFile = tempFile
+	h.Clock = clock
+	h.BackfillGauges = true
+	out := &bytes.Buffer{}
+	if err := h.writeMetricsValues(out, p); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		fmt.Sprintf("test.disk.sda.used\t1.000000\t%d\n", saved),
+		fmt.Sprintf("test.disk.sdb.used\t2.000000\t%d\n", saved),
+	} {
+		if !bytes.Contains(out.Bytes(), []byte(line)) {
+			t.Errorf("expected backfilled %q, got %q", line, out.String())
+		}
+	}
+	if bytes.Contains(out.Bytes(), []byte(fmt.Sprintf("test.disk.sdc.used\t3.000000\t%d", saved))) {
+		t.Errorf("a new series should not be backfilled: %q", out.String())
+	}
+	if n := bytes.Count(out.Bytes(), []byte("\n")); n != 4 {
+		t.Errorf("expected 2 backfilled and 2 fresh values, got %q", out.String())
+	}
+}
+
+func TestBackfillMaxAge(t *testing.T) {
+	p := testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"": {Metrics: []Metrics{{Name: "gauge"}}}},
+		values: map[string]interface{}{"gauge": 5.0},
+	}
+	for _, tc := range []struct {
+		name    string
+		maxAge  time.Duration
+		elapsed time.Duration
+		lines   int
+	}{
+		{"default", 0, 20 * time.Minute, 2},
+		{"default stale", 0, 21 * time.Minute, 1},
+		{"custom stale", time.Minute, 2 * time.Minute, 1},
+		{"unlimited", -1, 24 * time.Hour, 2},
+	} {
+		h := NewIdpcPlugin(p)
+		h.TempFile = filepath.Join(t.TempDir(), "state")
+		advance := testClock(&h)
+		if err := h.writeMetricsValues(io.Discard, p); err != nil {
+			t.Fatal(err)
+		}
+		advance(tc.elapsed)
+		h.backfilled = false
+		h.BackfillGauges = true
+		h.BackfillMaxAge = tc.maxAge
+		out := &bytes.Buffer{}
+		if err := h.writeMetricsValues(out, p); err != nil {
+			t.Fatal(err)
+		}
+		if n := bytes.Count(out.Bytes(), []byte("\n")); n != tc.lines {
+			t.Errorf("%s: expected %d lines, got %q", tc.name, tc.lines, out.String())
+		}
+	}
+}
+
+func TestBackfillRun(t *testing.T) {
+	p := testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"": {Metrics: []Metrics{{Name: "gauge"}}}},
+		values: map[string]interface{}{"gauge": 5.0},
+	}
+	h := NewIdpcPlugin(p)
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	advance := testClock(&h)
+	if err := h.writeMetricsValues(io.Discard, p); err != nil {
+		t.Fatal(err)
+	}
+	advance(time.Minute)
+	h.backfilled = false
+	h.BackfillGauges = true
+	out := &bytes.Buffer{}
+	h.Out = out
+	h.Run()
+	if n := bytes.Count(out.Bytes(), []byte("\n")); n != 1 {
+		t.Errorf("a one-shot Run should not backfill, got %q", out.String())
+	}
+}
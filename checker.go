@@ -0,0 +1,160 @@
+package plugin
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// FormatJSON 以JSON格式输出，见 IdpcPlugin.Format
+const FormatJSON = "json"
+
+// CheckResult 一次检查的状态和消息
+type CheckResult struct {
+	Status  Status
+	Message string
+}
+
+// checkerResult 检查结果的JSON格式
+type checkerResult struct {
+	Status   string     `json:"status"`
+	Message  string     `json:"message"`
+	Perfdata []PerfData `json:"perfdata"`
+}
+
+// Status 检查插件的检查结果状态
+type Status string
+
+const (
+	// StatusOK 正常，退出码0
+	StatusOK Status = "OK"
+	// StatusWarning 警告，退出码1
+	StatusWarning Status = "WARNING"
+	// StatusCritical 严重，退出码2
+	StatusCritical Status = "CRITICAL"
+	// StatusUnknown 未知，退出码3
+	StatusUnknown Status = "UNKNOWN"
+)
+
+// ExitCode 返回状态对应的Nagios风格退出码，不区分大小写，未知状态返回3(UNKNOWN)
+func (s Status) ExitCode() int {
+	switch Status(strings.ToUpper(string(s))) {
+	case StatusOK:
+		return 0
+	case StatusWarning:
+		return 1
+	case StatusCritical:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// OutputCheckerJSON 执行检查并以JSON格式输出结果到w，
+// 格式为 {"status":"WARNING","message":"...","perfdata":[...]}，进程退出码由检查状态决定。
+// perfdata 为 OutputCheckerValuesWithPerfData 传入的性能数据，否则为空数组
+func (h *IdpcPlugin) OutputCheckerJSON(w io.Writer) {
+	if mp, ok := h.checkerPlugin(); ok {
+		os.Exit(h.writeCheckerJSON(w, mp, nil))
+	}
+}
+
+func (h *IdpcPlugin) writeCheckerJSON(w io.Writer, mp CheckerPlugin, perf []PerfData) int {
+	message, status := h.check(mp)
+	result := checkerResult{
+		Status:   strings.ToUpper(string(status)),
+		Message:  message,
+		Perfdata: append([]PerfData{}, perf...),
+	}
+	err := json.NewEncoder(w).Encode(result)
+	if err != nil {
+		h.logger().Error().Err(err).Msg("OutputCheckerJSON: ")
+	}
+	return status.ExitCode()
+}
+
+// writeCheckerValues 执行检查并将消息写入w，返回检查状态对应的退出码
+func (h *IdpcPlugin) writeCheckerValues(w io.Writer, mp CheckerPlugin) int {
+	message, status := h.check(mp)
+	if _, err := io.WriteString(w, message+"\n"); err != nil {
+		h.logger().Error().Err(err).Msg("OutputCheckerValues: ")
+	}
+	return status.ExitCode()
+}
+
+// legacyCheckerPlugin 旧版本的检查插件接口，状态为字符串
+type legacyCheckerPlugin interface {
+	Plugin
+	Checker() (message string, status string)
+}
+
+// legacyChecker 将 legacyCheckerPlugin 适配为 CheckerPlugin
+type legacyChecker struct {
+	legacyCheckerPlugin
+}
+
+func (c legacyChecker) Checker() (message string, status Status) {
+	message, s := c.legacyCheckerPlugin.Checker()
+	return message, Status(s)
+}
+
+// checkerPlugin 返回插件的 CheckerPlugin 实现，兼容实现 Checker() (string, string) 的旧版本插件
+func (h *IdpcPlugin) checkerPlugin() (CheckerPlugin, bool) {
+	switch p := h.Plugin.(type) {
+	case CheckerPlugin:
+		return p, true
+	case legacyCheckerPlugin:
+		return legacyChecker{p}, true
+	}
+	return nil, false
+}
+
+// check 执行检查，通过 RunContext 运行且ctx被取消时不再等待检查完成，返回UNKNOWN
+func (h *IdpcPlugin) check(mp CheckerPlugin) (message string, status Status) {
+	ctx := h.runContext()
+	if ctx.Done() == nil {
+		return mp.Checker()
+	}
+	type result struct {
+		message string
+		status  Status
+	}
+	ch := make(chan result, 1)
+	go func() {
+		message, status := mp.Checker()
+		ch <- result{message, status}
+	}()
+	select {
+	case r := <-ch:
+		return r.message, r.status
+	case <-ctx.Done():
+		return ctx.Err().Error(), StatusUnknown
+	}
+}
+
+// RunCheckerWithTimeout 执行检查fn，fn在d内没有完成时不再等待，返回UNKNOWN和 "check timed out"。
+// d<=0 时不限制。fn在超时后仍会在后台运行直到返回
+func RunCheckerWithTimeout(d time.Duration, fn func() (Status, string)) (Status, string) {
+	if d <= 0 {
+		return fn()
+	}
+	type result struct {
+		status  Status
+		message string
+	}
+	ch := make(chan result, 1)
+	go func() {
+		status, message := fn()
+		ch <- result{status, message}
+	}()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		return r.status, r.message
+	case <-timer.C:
+		return StatusUnknown, "check timed out"
+	}
+}
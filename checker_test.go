@@ -0,0 +1,156 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutputCheckerJSON(t *testing.T) {
+	bin := buildTestPlugin(t, "testdata/checker-plugin.go")
+	for _, tc := range []struct {
+		status string
+		code   int
+	}{
+		{"OK", 0},
+		{"warning", 1},
+		{"CRITICAL", 2},
+		{"UNKNOWN", 3},
+		{"bogus", 3},
+	} {
+		stdout := &bytes.Buffer{}
+		cmd := exec.Command(bin, "-format", "json", "-status", tc.status, "-message", "disk 91% full")
+		cmd.Stdout = stdout
+		err := cmd.Run()
+		code := 0
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			code = exitErr.ExitCode()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if code != tc.code {
+			t.Errorf("status %s: exit code = %d, want %d", tc.status, code, tc.code)
+		}
+
+		var result map[string]interface{}
+		if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
+			t.Fatalf("status %s: %v: %q", tc.status, err, stdout.String())
+		}
+		perfdata, ok := result["perfdata"].([]interface{})
+		if len(result) != 3 || result["status"] != strings.ToUpper(tc.status) || result["message"] != "disk 91% full" || !ok || len(perfdata) != 0 {
+			t.Errorf("status %s: unexpected JSON %s", tc.status, stdout.String())
+		}
+	}
+}
+
+func TestOutputCheckerValues(t *testing.T) {
+	bin := buildTestPlugin(t, "testdata/checker-plugin.go")
+	for _, tc := range []struct {
+		status Status
+		code   int
+	}{
+		{StatusOK, 0},
+		{StatusWarning, 1},
+		{StatusCritical, 2},
+		{StatusUnknown, 3},
+		{"critical", 2},
+		{"bogus", 3},
+	} {
+		stdout := &bytes.Buffer{}
+		cmd := exec.Command(bin, "-status", string(tc.status), "-message", "disk 91% full")
+		cmd.Stdout = stdout
+		err := cmd.Run()
+		code := 0
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			code = exitErr.ExitCode()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if code != tc.code {
+			t.Errorf("status %s: exit code = %d, want %d", tc.status, code, tc.code)
+		}
+		if stdout.String() != "disk 91% full\n" {
+			t.Errorf("status %s: unexpected output %q", tc.status, stdout.String())
+		}
+	}
+}
+
+func TestStatusExitCode(t *testing.T) {
+	for status, want := range map[Status]int{
+		StatusOK:       0,
+		StatusWarning:  1,
+		StatusCritical: 2,
+		StatusUnknown:  3,
+		"warning":      1,
+		"":             3,
+		"bogus":        3,
+	} {
+		if got := status.ExitCode(); got != want {
+			t.Errorf("Status(%q).ExitCode() = %d, want %d", status, got, want)
+		}
+	}
+}
+
+func TestRunCheckerWithTimeout(t *testing.T) {
+	status, message := RunCheckerWithTimeout(20*time.Millisecond, func() (Status, string) {
+		time.Sleep(time.Second)
+		return StatusOK, "too late"
+	})
+	if status != StatusUnknown || message != "check timed out" {
+		t.Errorf("slow check = %s, %q, want UNKNOWN", status, message)
+	}
+
+	status, message = RunCheckerWithTimeout(time.Second, func() (Status, string) {
+		return StatusWarning, "disk 91% full"
+	})
+	if status != StatusWarning || message != "disk 91% full" {
+		t.Errorf("fast check = %s, %q", status, message)
+	}
+
+	status, _ = RunCheckerWithTimeout(0, func() (Status, string) {
+		return StatusCritical, ""
+	})
+	if status != StatusCritical {
+		t.Errorf("check without timeout = %s", status)
+	}
+}
+
+// legacyTestChecker implements the old Checker() (string, string) signature.
+type legacyTestChecker struct{}
+
+func (legacyTestChecker) Meta() Meta {
+	return Meta{Key: "test", Type: TypeChecker}
+}
+
+func (legacyTestChecker) Checker() (string, string) {
+	return "disk 91% full", "critical"
+}
+
+func TestLegacyChecker(t *testing.T) {
+	h := NewIdpcPlugin(legacyTestChecker{})
+	mp, ok := h.checkerPlugin()
+	if !ok {
+		t.Fatal("a legacy checker should be accepted")
+	}
+	buf := &bytes.Buffer{}
+	if code := h.writeCheckerValues(buf, mp); code != 2 {
+		t.Errorf("exit code = %d, want 2", code)
+	}
+	if buf.String() != "disk 91% full\n" {
+		t.Errorf("unexpected output %q", buf.String())
+	}
+
+	buf.Reset()
+	h.writeCheckerJSON(buf, mp, nil)
+	if !strings.Contains(buf.String(), `"status":"CRITICAL"`) {
+		t.Errorf("unexpected JSON %q", buf.String())
+	}
+
+	h = NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	if _, ok := h.checkerPlugin(); ok {
+		t.Error("a metrics plugin is not a checker")
+	}
+}
@@ -0,0 +1,109 @@
+package plugin
+
+import (
+	"time"
+)
+
+// CollectError 采集指标失败，Err为插件的 Metrics 方法返回的错误、ErrCollectTimeout 或context的错误
+type CollectError struct {
+	Err error
+}
+
+func (e *CollectError) Error() string {
+	return "collect metrics: " + e.Err.Error()
+}
+
+func (e *CollectError) Unwrap() error {
+	return e.Err
+}
+
+// CollectMetrics 采集并计算指标，返回所有图表的指标值而不输出，也不会退出进程。
+// 采集失败时返回 *CollectError，本次运行被跳过(例如距上次采集不足 MinInterval)时返回空结果和nil
+func (h *IdpcPlugin) CollectMetrics() ([]MetricLine, error) {
+	mp, ok := h.Plugin.(MetricsPlugin)
+	if !ok {
+		return nil, errNotMetricsPlugin
+	}
+	groups, _, err := h.collectValues(mp)
+	if err != nil {
+		if isSkip(err) {
+			h.logger().Debug().Err(err).Msg("CollectMetrics: ")
+			return nil, nil
+		}
+		return nil, err
+	}
+	var lines []MetricLine
+	for _, g := range groups {
+		for _, line := range g.lines {
+			if h.validValue(line.Name, line.Value) {
+				lines = append(lines, line)
+			}
+		}
+	}
+	h.feedSink(groups)
+	return lines, nil
+}
+
+// GraphMetricsPlugin 可选接口，指标插件实现后按图表并发采集指标，不再调用 Metrics。
+// Timeout 作为所有图表共享的时间预算，超时未完成的图表被跳过，已完成图表的指标正常输出
+type GraphMetricsPlugin interface {
+	MetricsPlugin
+	// GraphMetrics 采集 GraphDefinition 中key对应图表的指标
+	GraphMetrics(key string) (map[string]interface{}, error)
+}
+
+// fetchGraphMetrics 并发采集每个图表的指标并合并，
+// 出错或超时的图表被跳过，所有图表都没有完成时返回错误
+func (h *IdpcPlugin) fetchGraphMetrics(gp GraphMetricsPlugin) (map[string]interface{}, error) {
+	type result struct {
+		key  string
+		stat map[string]interface{}
+		err  error
+	}
+	defs := h.graphDefinition(gp)
+	ch := make(chan result, len(defs))
+	for key := range defs {
+		go func(key string) {
+			stat, err := gp.GraphMetrics(key)
+			ch <- result{key, stat, err}
+		}(key)
+	}
+
+	var deadline <-chan time.Time
+	if h.Timeout > 0 {
+		timer := time.NewTimer(h.Timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	stat := make(map[string]interface{})
+	var firstErr error
+	completed := 0
+	for pending := len(defs); pending > 0; pending-- {
+		select {
+		case r := <-ch:
+			if r.err != nil {
+				h.logger().Error().Err(r.err).Msgf("GraphMetrics %q: ", r.key)
+				if firstErr == nil {
+					firstErr = r.err
+				}
+				continue
+			}
+			completed++
+			for k, v := range r.stat {
+				stat[k] = v
+			}
+		case <-h.runContext().Done():
+			return nil, h.runContext().Err()
+		case <-deadline:
+			h.logger().Warn().Msgf("GraphMetrics: %d of %d graphs did not complete in %s", pending, len(defs), h.Timeout)
+			if completed == 0 {
+				return nil, ErrCollectTimeout
+			}
+			return stat, nil
+		}
+	}
+	if completed == 0 && firstErr != nil {
+		return nil, firstErr
+	}
+	return stat, nil
+}
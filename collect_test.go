@@ -0,0 +1,114 @@
+package plugin
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testGraphPlugin struct {
+	testMetricsPlugin
+	delays map[string]time.Duration
+}
+
+func (p testGraphPlugin) GraphMetrics(key string) (map[string]interface{}, error) {
+	time.Sleep(p.delays[key])
+	return map[string]interface{}{key + "_value": 1.0}, nil
+}
+
+func TestGraphMetricsBudget(t *testing.T) {
+	p := testGraphPlugin{
+		testMetricsPlugin: testMetricsPlugin{
+			key: "test",
+			graphs: map[string]Graphs{
+				"fast": {Metrics: []Metrics{{Name: "fast_value"}}},
+				"also": {Metrics: []Metrics{{Name: "also_value"}}},
+				"slow": {Metrics: []Metrics{{Name: "slow_value"}}},
+			},
+		},
+		delays: map[string]time.Duration{"also": 20 * time.Millisecond, "slow": 2 * time.Second},
+	}
+	h := NewIdpcPlugin(p)
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	h.Timeout = 200 * time.Millisecond
+
+	start := time.Now()
+	out := &bytes.Buffer{}
+	if err := h.writeMetricsValues(out, p); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("collection took %v, longer than the budget", d)
+	}
+	for _, name := range []string{"test.fast.fast_value\t", "test.also.also_value\t"} {
+		if !strings.Contains(out.String(), name) {
+			t.Errorf("completed graph %q missing from %q", name, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "test.slow.slow_value") {
+		t.Errorf("slow graph should be skipped: %q", out.String())
+	}
+}
+
+func TestGraphMetricsAllTimedOut(t *testing.T) {
+	p := testGraphPlugin{
+		testMetricsPlugin: testMetricsPlugin{
+			key:    "test",
+			graphs: map[string]Graphs{"slow": {Metrics: []Metrics{{Name: "slow_value"}}}},
+		},
+		delays: map[string]time.Duration{"slow": time.Second},
+	}
+	h := NewIdpcPlugin(p)
+	h.Timeout = 50 * time.Millisecond
+	if _, err := h.fetchMetrics(p); err != ErrCollectTimeout {
+		t.Errorf("expected %v, got %v", ErrCollectTimeout, err)
+	}
+}
+
+func TestCollectMetrics(t *testing.T) {
+	p := testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"mem": {Metrics: []Metrics{{Name: "used"}, {Name: "bad", Scale: 10}}}},
+		values: map[string]interface{}{"used": 1.5, "bad": math.MaxFloat64},
+	}
+	h := NewIdpcPlugin(p)
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	lines, err := h.CollectMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 || lines[0].Name != "test.mem.used" || lines[0].Value != 1.5 || lines[0].Time.IsZero() {
+		t.Errorf("unexpected lines %+v", lines)
+	}
+
+	// a run right after the last one is skipped without an error
+	h.MinInterval = time.Hour
+	if lines, err := h.CollectMetrics(); err != nil || len(lines) != 0 {
+		t.Errorf("skipped run: got %+v, %v", lines, err)
+	}
+}
+
+func TestCollectMetricsError(t *testing.T) {
+	errBackend := errors.New("backend unavailable")
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test", err: errBackend})
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	lines, err := h.CollectMetrics()
+	if lines != nil {
+		t.Errorf("expected no lines, got %+v", lines)
+	}
+	var collectErr *CollectError
+	if !errors.As(err, &collectErr) || collectErr.Err != errBackend || !errors.Is(err, errBackend) {
+		t.Errorf("expected a CollectError wrapping %v, got %v", errBackend, err)
+	}
+
+	h = NewIdpcPlugin(testMetricsPlugin{key: "test", delay: time.Second})
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	h.Timeout = 10 * time.Millisecond
+	if _, err := h.CollectMetrics(); !errors.Is(err, ErrCollectTimeout) {
+		t.Errorf("expected ErrCollectTimeout, got %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Constraint 版本范围约束，所有条件都满足时匹配，没有条件时匹配任意版本
+type Constraint struct {
+	terms []constraintTerm
+}
+
+type constraintTerm struct {
+	op      string
+	version Version
+}
+
+// ParseConstraint 解析版本约束，例如 ">=1.2.0 <2.0.0" 或 ">= 1.2.0, < 2.0.0"。
+// 支持的运算符为 >=、>、<=、<、=，省略运算符时为 =，条件之间以空白或逗号分隔
+func ParseConstraint(s string) (Constraint, error) {
+	var c Constraint
+	i := 0
+	for {
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t' || s[i] == ',') {
+			i++
+		}
+		if i == len(s) {
+			return c, nil
+		}
+		start := i
+		for i < len(s) && strings.IndexByte("<>=", s[i]) >= 0 {
+			i++
+		}
+		op := s[start:i]
+		switch op {
+		case "":
+			op = "="
+		case ">=", ">", "<=", "<", "=":
+		default:
+			return Constraint{}, fmt.Errorf("invalid operator %q in %q", op, s)
+		}
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+			i++
+		}
+		start = i
+		for i < len(s) && strings.IndexByte(" \t,<>=", s[i]) < 0 {
+			i++
+		}
+		if start == i {
+			return Constraint{}, fmt.Errorf("missing version after %q in %q", op, s)
+		}
+		v, err := ParseVersion(s[start:i])
+		if err != nil {
+			return Constraint{}, err
+		}
+		c.terms = append(c.terms, constraintTerm{op, v})
+	}
+}
+
+// Check 判断版本是否满足约束
+func (c Constraint) Check(v Version) bool {
+	for _, t := range c.terms {
+		n := v.Compare(t.version)
+		var ok bool
+		switch t.op {
+		case ">=":
+			ok = n >= 0
+		case ">":
+			ok = n > 0
+		case "<=":
+			ok = n <= 0
+		case "<":
+			ok = n < 0
+		default:
+			ok = n == 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (c Constraint) String() string {
+	terms := make([]string, len(c.terms))
+	for i, t := range c.terms {
+		terms[i] = t.op + t.version.String()
+	}
+	return strings.Join(terms, ", ")
+}
@@ -0,0 +1,42 @@
+package plugin
+
+import (
+	"testing"
+)
+
+func TestConstraint(t *testing.T) {
+	for _, tc := range []struct {
+		constraint string
+		matches    []string
+		rejects    []string
+	}{
+		{">=1.2.0 <2.0.0", []string{"1.2.0", "1.9.9"}, []string{"1.1.9", "2.0.0", "1.2.0-rc1"}},
+		{" >= 1.2.0 , < 2.0.0 ", []string{"1.2.0", "1.10.0"}, []string{"2.0.0"}},
+		{">1.0.0,<=1.1.0", []string{"1.0.1", "1.1.0"}, []string{"1.0.0", "1.1.1"}},
+		{"=1.2.3", []string{"1.2.3"}, []string{"1.2.4"}},
+		{"v1.2.3", []string{"1.2.3"}, []string{"1.2.2"}},
+		{"", []string{"0.0.0", "9.9.9"}, nil},
+	} {
+		c, err := ParseConstraint(tc.constraint)
+		if err != nil {
+			t.Errorf("%q: %v", tc.constraint, err)
+			continue
+		}
+		for _, s := range tc.matches {
+			if !c.Check(MustParseVersion(s)) {
+				t.Errorf("%q should match %s", tc.constraint, s)
+			}
+		}
+		for _, s := range tc.rejects {
+			if c.Check(MustParseVersion(s)) {
+				t.Errorf("%q should not match %s", tc.constraint, s)
+			}
+		}
+	}
+
+	for _, bad := range []string{"=>1.0.0", ">=", "<1.0", ">= 1.0.0 <"} {
+		if _, err := ParseConstraint(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package plugin
+
+import (
+	"io"
+	"time"
+)
+
+// DropReason 指标被丢弃的原因
+type DropReason string
+
+const (
+	// DropMissing Metrics 返回的值中不存在该指标
+	DropMissing DropReason = "missing"
+	// DropInvalid 值为NaN或Inf
+	DropInvalid DropReason = "invalid"
+	// DropNoLastValue Diff指标在上次采集中不存在
+	DropNoLastValue DropReason = "no_last_value"
+	// DropReset 计数器被重置
+	DropReset DropReason = "reset"
+	// DropTooLongDuration 距上次采集的时间过长，无法计算差值
+	DropTooLongDuration DropReason = "too_long_duration"
+	// DropOutOfOrder 采集时间不晚于上次采集的时间
+	DropOutOfOrder DropReason = "out_of_order"
+	// DropOutOfRange 值超出 Metrics.Min/Max 范围
+	DropOutOfRange DropReason = "out_of_range"
+)
+
+var dropReasons = []DropReason{
+	DropMissing, DropInvalid, DropNoLastValue, DropReset, DropTooLongDuration, DropOutOfOrder, DropOutOfRange,
+}
+
+func diffDropReason(err error) DropReason {
+	switch err {
+	case errTooLongDuration:
+		return DropTooLongDuration
+	case errOutOfOrder, errSameTimestamp:
+		return DropOutOfOrder
+	default:
+		return DropReset
+	}
+}
+
+func (h *IdpcPlugin) drop(reason DropReason) {
+	if h.dropped == nil {
+		h.dropped = make(map[DropReason]int)
+	}
+	h.dropped[reason]++
+}
+
+// Dropped 返回最近一次运行中按原因统计的丢弃指标数量
+func (h *IdpcPlugin) Dropped() map[DropReason]int {
+	dropped := make(map[DropReason]int, len(h.dropped))
+	for reason, n := range h.dropped {
+		dropped[reason] = n
+	}
+	return dropped
+}
+
+// printDropped 按原因输出 key.plugin.dropped 指标
+func (h *IdpcPlugin) printDropped(w io.Writer, now time.Time) {
+	name := h.metricName(h.Plugin.Meta().Key + ".plugin.dropped")
+	for _, reason := range dropReasons {
+		labels := []Label{{Name: "reason", Value: string(reason)}}
+		h.printValue(w, labeledName(name, labels), uint64(h.dropped[reason]), now)
+	}
+}
@@ -0,0 +1,116 @@
+package plugin
+
+import (
+	"bytes"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDropped(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	now := time.Unix(1700000600, 0)
+	values := PluginValues{
+		Values: map[string]interface{}{
+			"nan":     math.NaN(),
+			"counter": 10.0,
+			"new":     1.0,
+			"big":     1000.0,
+		},
+		Timestamp: now,
+	}
+	recent := PluginValues{Values: map[string]interface{}{"counter": 20.0}, Timestamp: now.Add(-time.Minute)}
+	old := PluginValues{Values: map[string]interface{}{"counter": 5.0}, Timestamp: now.Add(-time.Hour)}
+
+	for _, tc := range []struct {
+		metric Metrics
+		last   PluginValues
+	}{
+		{Metrics{Name: "missing"}, recent},
+		{Metrics{Name: "nan"}, recent},
+		{Metrics{Name: "counter", Diff: true}, recent},
+		{Metrics{Name: "counter", Diff: true}, old},
+		{Metrics{Name: "new", Diff: true}, recent},
+		{Metrics{Name: "big", Max: Bound(100)}, recent},
+		{Metrics{Name: "big", Max: Bound(100)}, recent},
+	} {
+		if _, ok := h.formatValues("", tc.metric, values, tc.last); ok {
+			t.Errorf("%+v should be dropped", tc.metric)
+		}
+	}
+
+	want := map[DropReason]int{
+		DropMissing:         1,
+		DropInvalid:         1,
+		DropReset:           1,
+		DropTooLongDuration: 1,
+		DropNoLastValue:     1,
+		DropOutOfRange:      2,
+	}
+	got := h.Dropped()
+	for reason, n := range want {
+		if got[reason] != n {
+			t.Errorf("Dropped()[%s] = %d, want %d", reason, got[reason], n)
+		}
+	}
+}
+
+func TestEmitDropped(t *testing.T) {
+	p := testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"": {Metrics: []Metrics{{Name: "missing"}}}},
+		values: map[string]interface{}{},
+	}
+	h := NewIdpcPlugin(p)
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	h.EmitDropped = true
+	buf := &bytes.Buffer{}
+	if err := h.writeMetricsValues(buf, p); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "test.plugin.dropped;reason=missing\t1\t") ||
+		!strings.Contains(buf.String(), "test.plugin.dropped;reason=reset\t0\t") {
+		t.Errorf("unexpected dropped metrics: %q", buf.String())
+	}
+}
+
+func TestIntermittentDiff(t *testing.T) {
+	values := map[string]interface{}{"always": 1.0}
+	p := testMetricsPlugin{
+		key: "test",
+		graphs: map[string]Graphs{"": {Metrics: []Metrics{
+			{Name: "always"},
+			{Name: "feature", Diff: true, IntermittentDiff: true},
+		}}},
+		values: values,
+	}
+	h := NewIdpcPlugin(p)
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	advance := testClock(&h)
+
+	for i, feature := range []interface{}{100.0, nil, 130.0, 190.0} {
+		if feature == nil {
+			delete(values, "feature")
+		} else {
+			values["feature"] = feature
+		}
+		advance(time.Minute)
+		out := &bytes.Buffer{}
+		if err := h.writeMetricsValues(out, p); err != nil {
+			t.Fatal(err)
+		}
+		if h.Dropped()[DropNoLastValue] != 0 {
+			t.Errorf("run %d: a reappearing metric should not be counted as dropped: %v", i+1, h.Dropped())
+		}
+		emitted := strings.Contains(out.String(), "test.feature\t")
+		if i == 3 {
+			if !strings.Contains(out.String(), "test.feature\t60.000000\t") {
+				t.Errorf("run %d: expected the diff after the metric reappeared: %q", i+1, out.String())
+			}
+		} else if emitted {
+			t.Errorf("run %d: unexpected feature value: %q", i+1, out.String())
+		}
+	}
+}
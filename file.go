@@ -0,0 +1,68 @@
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// FileOptions OutputFile 的文件轮转设置
+type FileOptions struct {
+	// MaxSize 文件超过该大小(字节)时轮转，为0时不轮转
+	MaxSize int64
+	// MaxFiles 保留的轮转文件数量，轮转文件名为 path.1 ~ path.N，path.1 最新
+	MaxFiles int
+}
+
+// OutputFile 采集指标并将输出追加到path文件中，写入后文件会超过 opts.MaxSize 时先进行轮转。
+// 设置了签名密钥(见 SignKey)时每次运行追加一个单独签名的块，可以使用 VerifySignedOutput 校验整个文件
+func (h *IdpcPlugin) OutputFile(path string, opts FileOptions) error {
+	mp, ok := h.Plugin.(MetricsPlugin)
+	if !ok {
+		return errNotMetricsPlugin
+	}
+	buf := &bytes.Buffer{}
+	if err := h.writeMetricsValues(buf, mp); err != nil {
+		return err
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	if opts.MaxSize > 0 {
+		fi, err := os.Stat(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil && fi.Size() > 0 && fi.Size()+int64(buf.Len()) > opts.MaxSize {
+			if err := rotateFile(path, opts.MaxFiles); err != nil {
+				return fmt.Errorf("rotate %s: %w", path, err)
+			}
+		}
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := buf.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rotateFile 将 path.i 重命名为 path.i+1，path 重命名为 path.1，删除超过maxFiles的文件
+func rotateFile(path string, maxFiles int) error {
+	if maxFiles <= 0 {
+		return os.Remove(path)
+	}
+	if err := os.Remove(fmt.Sprintf("%s.%d", path, maxFiles)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := maxFiles - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(path, path+".1")
+}
@@ -0,0 +1,44 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOutputFileRotation(t *testing.T) {
+	p := testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"": {Metrics: []Metrics{{Name: "value"}}}},
+		values: map[string]interface{}{"value": 1.0},
+	}
+	h := NewIdpcPlugin(p)
+	dir := t.TempDir()
+	h.TempFile = filepath.Join(dir, "state")
+	path := filepath.Join(dir, "metrics.log")
+	advance := testClock(&h)
+
+	// each run writes one line of about 30 bytes
+	opts := FileOptions{MaxSize: 50, MaxFiles: 2}
+	for i := 0; i < 7; i++ {
+		advance(time.Minute)
+		if err := h.OutputFile(path, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Errorf("expected %s to exist: %v", name, err)
+			continue
+		}
+		if fi.Size() > opts.MaxSize {
+			t.Errorf("%s is larger than MaxSize: %d", name, fi.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("only MaxFiles rotated files should be kept: %v", err)
+	}
+}
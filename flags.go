@@ -0,0 +1,95 @@
+package plugin
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// CommonFlags 插件通用的命令行参数(-host、-port、-tempFile、-format、-mode、-warmup、-v)，由 NewFlagSet 创建，
+// 插件可以在调用 Parse 之前通过内嵌的 FlagSet 注册自己的参数
+type CommonFlags struct {
+	*flag.FlagSet
+	Host     string
+	Port     string
+	TempFile string
+	// Format 输出格式，见 IdpcPlugin.Format
+	Format string
+	// Mode 运行的插件类型，见 IdpcPlugin.Mode
+	Mode string
+	// Warmup 指定了 -warmup 参数，见 IdpcPlugin.Warmup
+	Warmup bool
+	// ShowVersion 指定了 -v 参数
+	ShowVersion bool
+}
+
+// NewFlagSet 创建注册了通用参数的 CommonFlags，meta的key用于参数帮助信息中的命令名称
+func NewFlagSet(meta Meta) *CommonFlags {
+	f := &CommonFlags{
+		FlagSet: flag.NewFlagSet(fmt.Sprintf("%s-%s", PLUGIN_PREFIX, meta.Key), flag.ExitOnError),
+	}
+	f.StringVar(&f.Host, "host", "localhost", "Hostname")
+	f.StringVar(&f.Port, "port", "", "Port")
+	f.StringVar(&f.TempFile, "tempFile", "", "Temp file name")
+	f.StringVar(&f.Format, "format", "", "Output format (json, prometheus, influx), default tab separated")
+	f.StringVar(&f.Mode, "mode", "", "Plugin type to run (metrics, checker, metadata)")
+	f.BoolVar(&f.Warmup, "warmup", false, "Collect and save state without output")
+	f.BoolVar(&f.ShowVersion, "v", false, "Print version and exit")
+	return f
+}
+
+// Parse 解析参数，通常为 os.Args[1:]
+func (f *CommonFlags) Parse(args []string) error {
+	return f.FlagSet.Parse(args)
+}
+
+// Addr 返回 host:port 格式的地址，未指定 -port 时使用defaultPort
+func (f *CommonFlags) Addr(defaultPort string) string {
+	port := f.Port
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(f.Host, port)
+}
+
+// Apply 将解析后的参数设置到h，未指定 -tempFile 时状态文件位于 PluginWorkDir 下。
+// -mode 不是 metrics、checker 或 metadata 时返回错误，不修改h
+func (f *CommonFlags) Apply(h *IdpcPlugin) error {
+	mode := Type(strings.ToLower(f.Mode))
+	if f.Mode != "" && !validType(mode) {
+		return fmt.Errorf("invalid value %q for flag -mode: must be metrics, checker or metadata", f.Mode)
+	}
+	if f.TempFile != "" {
+		h.TempFile = f.TempFile
+	}
+	if f.Format != "" {
+		h.Format = f.Format
+	}
+	if f.Mode != "" {
+		h.Mode = mode
+	}
+	return nil
+}
+
+// Run 调用 Apply 后运行h，Apply 返回错误时与参数解析错误一样输出用法并以退出码2退出进程：指定了 -v 或第一个参数为 version 时输出版本(遵循 RedactVersion，输出到 Out)，
+// 指定了 -warmup 时只采集并保存状态，出错时以 ErrorExitCodes 对应的退出码退出进程，否则调用 h.Run
+func (f *CommonFlags) Run(h *IdpcPlugin) {
+	if err := f.Apply(h); err != nil {
+		fmt.Fprintln(f.Output(), err)
+		f.Usage()
+		os.Exit(2)
+	}
+	switch {
+	case f.ShowVersion || f.Arg(0) == "version":
+		fmt.Fprintln(h.out(), h.Version())
+	case f.Warmup:
+		if err := h.Warmup(); err != nil {
+			h.logger().Error().Err(err).Msg("Warmup: ")
+			os.Exit(h.exitCode(err))
+		}
+	default:
+		h.Run()
+	}
+}
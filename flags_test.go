@@ -0,0 +1,105 @@
+package plugin
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFlagSet(t *testing.T) {
+	bin := buildTestPlugin(t, "testdata/flags-plugin.go")
+	for _, arg := range []string{"-v", "version"} {
+		out, err := exec.Command(bin, arg).Output()
+		if err != nil {
+			t.Fatalf("%s: %v", arg, err)
+		}
+		if !strings.HasPrefix(string(out), PLUGIN_PREFIX+"-test-metrics version 1.2.3 (rev abc)") {
+			t.Errorf("%s: unexpected version output %q", arg, out)
+		}
+	}
+
+	out, err := exec.Command(bin, "-v", "-redact").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(out), PLUGIN_PREFIX+"-test-metrics version 1.2.3 (rev "+redactedField+")") {
+		t.Errorf("-v should follow RedactVersion: %q", out)
+	}
+
+	out, err = exec.Command(bin, "-host", "example.com", "-addr").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "example.com:11211\n" {
+		t.Errorf("unexpected address %q", out)
+	}
+
+	tempFile := filepath.Join(t.TempDir(), "state")
+	out, err = exec.Command(bin, "-tempFile", tempFile).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(out), "test.value\t1") {
+		t.Errorf("unexpected output %q", out)
+	}
+	if _, err := os.Stat(tempFile); err != nil {
+		t.Errorf("state was not saved to -tempFile: %v", err)
+	}
+
+	warmupFile := filepath.Join(t.TempDir(), "state")
+	out, err = exec.Command(bin, "-warmup", "-tempFile", warmupFile).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 0 {
+		t.Errorf("-warmup should not output anything, got %q", out)
+	}
+	if _, err := os.Stat(warmupFile); err != nil {
+		t.Errorf("-warmup did not save state: %v", err)
+	}
+
+	out, err = exec.Command(bin, "-mode", "metadata", "-tempFile", warmupFile).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 0 {
+		t.Errorf("-mode metadata on a metrics-only plugin should not output anything, got %q", out)
+	}
+
+	cmd := exec.Command(bin, "-mode", "bogus", "-tempFile", warmupFile)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err = cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 2 {
+		t.Errorf("-mode bogus: got %v, want exit code 2", err)
+	}
+	if len(out) != 0 || !strings.Contains(stderr.String(), `invalid value "bogus" for flag -mode`) {
+		t.Errorf("-mode bogus: unexpected output %q, stderr %q", out, stderr)
+	}
+}
+
+func TestFlagsApply(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	f := NewFlagSet(h.Plugin.Meta())
+	if err := f.Parse([]string{"-mode", "Checker", "-format", "json"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Apply(&h); err != nil {
+		t.Fatal(err)
+	}
+	if h.Mode != TypeChecker || h.Format != FormatJSON {
+		t.Errorf("unexpected mode %q and format %q", h.Mode, h.Format)
+	}
+
+	h = NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	f = NewFlagSet(h.Plugin.Meta())
+	if err := f.Parse([]string{"-mode", "bogus", "-format", "json"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Apply(&h); err == nil || h.Mode != "" || h.Format != "" {
+		t.Errorf("invalid -mode should be rejected without changing the plugin: %v, %q, %q", err, h.Mode, h.Format)
+	}
+}
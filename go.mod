@@ -1,5 +1,9 @@
-module github.com/gorpher/go-miao-plugin
+module github.com/gorpher/go-idpc-plugin
 
 go 1.16
 
-require github.com/rs/zerolog v1.23.0
+require (
+	github.com/rs/zerolog v1.23.0
+	golang.org/x/crypto v0.1.0
+	golang.org/x/sys v0.1.0
+)
@@ -0,0 +1,281 @@
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// LoadGraphDefinition 从JSON文件加载图表定义，文件内容为图表key到图表定义的映射，
+// 格式与 MetricsPlugin.GraphDefinition 的返回值一致
+func LoadGraphDefinition(path string) (map[string]Graphs, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return decodeGraphDefinition(f)
+}
+
+func decodeGraphDefinition(r io.Reader) (map[string]Graphs, error) {
+	var graphs map[string]Graphs
+	err := json.NewDecoder(r).Decode(&graphs)
+	if err != nil {
+		return nil, err
+	}
+	return graphs, nil
+}
+
+// GraphDefError 图表定义中的一个错误
+type GraphDefError struct {
+	Graph  string
+	Metric string
+	Reason string
+}
+
+func (e *GraphDefError) Error() string {
+	if e.Metric != "" {
+		return fmt.Sprintf("graph %q: metric %q: %s", e.Graph, e.Metric, e.Reason)
+	}
+	return fmt.Sprintf("graph %q: %s", e.Graph, e.Reason)
+}
+
+// GraphDefErrors ValidateGraphDef 发现的所有错误
+type GraphDefErrors []*GraphDefError
+
+func (e GraphDefErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// knownUnits 图表单位的可选值，见 UnitFloat 等常量
+var knownUnits = map[string]bool{
+	UnitFloat:          true,
+	UnitInteger:        true,
+	UnitPercentage:     true,
+	UnitBytes:          true,
+	UnitBytesPerSecond: true,
+	UnitIOPS:           true,
+}
+
+// ValidateGraphDef 校验图表定义，包括图表的Unit是否为 UnitFloat 等已知单位(为空时不检查)、
+// 同一图表中重复的指标名称，以及不同图表输出的同名指标(例如图表 "a" 的 "b.c" 和图表 "a.b" 的 "c")，
+// 返回按图表key排序的 GraphDefErrors，没有错误时返回nil
+func ValidateGraphDef(defs map[string]Graphs) error {
+	keys := make([]string, 0, len(defs))
+	for key := range defs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs GraphDefErrors
+	// outputNames 图表key之后的输出名称到图表key的映射，用于发现不同图表输出同名指标
+	outputNames := make(map[string]string)
+	for _, key := range keys {
+		graph := defs[key]
+		if len(graph.Metrics) == 0 {
+			errs = append(errs, &GraphDefError{Graph: key, Reason: "no metrics"})
+		}
+		if graph.Unit != "" && !knownUnits[graph.Unit] {
+			errs = append(errs, &GraphDefError{Graph: key, Reason: fmt.Sprintf("unknown unit %q", graph.Unit)})
+		}
+		names := make(map[string]bool, len(graph.Metrics))
+		for _, metric := range graph.Metrics {
+			if metric.Name == "" {
+				errs = append(errs, &GraphDefError{Graph: key, Reason: "metric with empty name"})
+				continue
+			}
+			if names[metric.Name] {
+				errs = append(errs, &GraphDefError{Graph: key, Metric: metric.Name, Reason: "duplicate metric name"})
+				continue
+			}
+			names[metric.Name] = true
+			full := metric.Name
+			if key != "" {
+				full = key + "." + metric.Name
+			}
+			if other, ok := outputNames[full]; ok {
+				errs = append(errs, &GraphDefError{Graph: key, Metric: metric.Name, Reason: fmt.Sprintf("same output name %q as graph %q", full, other)})
+				continue
+			}
+			outputNames[full] = key
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ValidateGraphDefReader 从r读取JSON格式的图表定义并校验，
+// 校验通过时将格式化后的定义写入w，否则将每个错误写入w并返回错误
+func ValidateGraphDefReader(r io.Reader, w io.Writer) error {
+	defs, err := decodeGraphDefinition(r)
+	if err != nil {
+		fmt.Fprintf(w, "invalid graph definition: %s\n", err)
+		return err
+	}
+	err = ValidateGraphDef(defs)
+	if err != nil {
+		if errs, ok := err.(GraphDefErrors); ok {
+			for _, e := range errs {
+				fmt.Fprintln(w, e)
+			}
+		}
+		return err
+	}
+	b, err := json.MarshalIndent(defs, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// graphDefinition 返回插件的图表定义，并合并 GraphOverrides 中的外部定义
+func (h *IdpcPlugin) graphDefinition(mp MetricsPlugin) map[string]Graphs {
+	defs := mp.GraphDefinition()
+	if len(h.GraphOverrides) > 0 {
+		defs = mergeGraphDefinition(defs, h.GraphOverrides)
+	}
+	if len(h.SelectGraphs) > 0 {
+		defs = h.selectGraphs(defs, h.SelectGraphs)
+	}
+	return defs
+}
+
+// selectGraphs 返回defs中key在names中的图表，不存在的key记录警告日志
+func (h *IdpcPlugin) selectGraphs(defs map[string]Graphs, names []string) map[string]Graphs {
+	selected := make(map[string]Graphs, len(names))
+	for _, name := range names {
+		graph, ok := defs[name]
+		if !ok {
+			h.logger().Warn().Msgf("SelectGraphs: unknown graph %q", name)
+			continue
+		}
+		selected[name] = graph
+	}
+	return selected
+}
+
+// mergeGraphDefinition 将overrides合并到defs中，不修改defs本身。
+// 非空的Label和Unit覆盖原有值，Stacked在任一方设置时生效；
+// Diff、Type、Scale等无法从JSON读取的字段保持原有值。
+// defs中不存在的图表和指标直接追加。
+func mergeGraphDefinition(defs, overrides map[string]Graphs) map[string]Graphs {
+	merged := make(map[string]Graphs, len(defs)+len(overrides))
+	for key, graph := range defs {
+		merged[key] = graph
+	}
+	for key, override := range overrides {
+		graph, ok := merged[key]
+		if !ok {
+			merged[key] = override
+			continue
+		}
+		if override.Label != "" {
+			graph.Label = override.Label
+		}
+		if override.Unit != "" {
+			graph.Unit = override.Unit
+		}
+		metrics := make([]Metrics, len(graph.Metrics))
+		copy(metrics, graph.Metrics)
+	overrideMetrics:
+		for _, om := range override.Metrics {
+			for i, m := range metrics {
+				if m.Name != om.Name {
+					continue
+				}
+				if om.Label != "" {
+					metrics[i].Label = om.Label
+				}
+				metrics[i].Stacked = m.Stacked || om.Stacked
+				continue overrideMetrics
+			}
+			metrics = append(metrics, om)
+		}
+		graph.Metrics = metrics
+		merged[key] = graph
+	}
+	return merged
+}
+
+// GraphDefinitionHash 返回图表定义(包括 GraphOverrides)的SHA-256十六进制摘要，
+// 可用于在部署之间检测图表定义的变化。摘要与map的遍历顺序无关，
+// 只包含 graphDefinitionFields 和 metricDefinitionFields 列出的字段
+func (h *IdpcPlugin) GraphDefinitionHash() (string, error) {
+	mp, ok := h.Plugin.(MetricsPlugin)
+	if !ok {
+		return "", errNotMetricsPlugin
+	}
+	canonical := make(map[string]interface{})
+	for key, graph := range h.graphDefinition(mp) {
+		metrics := make([]map[string]interface{}, len(graph.Metrics))
+		for i, metric := range graph.Metrics {
+			metrics[i] = nonZeroFields(metricDefinitionFields(metric))
+		}
+		def := nonZeroFields(graphDefinitionFields(graph))
+		def["Metrics"] = metrics
+		canonical[key] = def
+	}
+	// json.Marshal 按key排序输出map
+	b, err := json.Marshal(canonical)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// graphDefinitionFields 参与 GraphDefinitionHash 计算的图表字段，Metrics 单独处理
+func graphDefinitionFields(graph Graphs) map[string]interface{} {
+	return map[string]interface{}{
+		"Label": graph.Label,
+		"Unit":  graph.Unit,
+	}
+}
+
+// metricDefinitionFields 参与 GraphDefinitionHash 计算的指标字段。
+// Metrics 新增的字段需要显式加入这里，零值字段不参与计算，所以新增字段不会改变没有使用它的定义的摘要
+func metricDefinitionFields(m Metrics) map[string]interface{} {
+	return map[string]interface{}{
+		"Name":             m.Name,
+		"Label":            m.Label,
+		"Diff":             m.Diff,
+		"Type":             m.Type,
+		"Stacked":          m.Stacked,
+		"Scale":            m.Scale,
+		"AbsoluteName":     m.AbsoluteName,
+		"Min":              m.Min,
+		"Max":              m.Max,
+		"Clamp":            m.Clamp,
+		"Round":            m.Round,
+		"TimestampOffset":  m.TimestampOffset,
+		"RatePerSecond":    m.RatePerSecond,
+		"EmitBoth":         m.EmitBoth,
+		"RatioIsFraction":  m.RatioIsFraction,
+		"IntermittentDiff": m.IntermittentDiff,
+		"AllowDecrease":    m.AllowDecrease,
+		"DurationUnit":     m.DurationUnit,
+	}
+}
+
+// nonZeroFields 删除fields中的零值，非nil的指针即使指向零值也保留
+func nonZeroFields(fields map[string]interface{}) map[string]interface{} {
+	for name, v := range fields {
+		if reflect.ValueOf(v).IsZero() {
+			delete(fields, name)
+		}
+	}
+	return fields
+}
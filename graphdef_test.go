@@ -0,0 +1,214 @@
+package plugin
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadGraphDefinitionOverride(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "graphs.json")
+	err := os.WriteFile(path, []byte(`{
+		"cmd": {"unit": "float", "metrics": [{"name": "cmd_get", "label": "Custom Get"}, {"name": "cmd_new"}]},
+		"extra": {"label": "Extra", "unit": "integer", "metrics": [{"name": "extra"}]}
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	overrides, err := LoadGraphDefinition(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	builtin := map[string]Graphs{
+		"cmd": {
+			Label: "Command",
+			Unit:  UnitInteger,
+			Metrics: []Metrics{
+				{Name: "cmd_get", Label: "Get", Diff: true},
+				{Name: "cmd_set", Label: "Set", Diff: true},
+			},
+		},
+	}
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test", graphs: builtin})
+	h.GraphOverrides = overrides
+
+	buf := &bytes.Buffer{}
+	h.writeMeta(buf)
+	out := buf.String()
+	for _, want := range []string{
+		`"label":"Custom Get"`,
+		`"label":"Set"`,
+		`"label":"Cmd New"`,
+		`"label":"Command","unit":"float"`,
+		`"test.extra":{"label":"Extra"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("OutputMeta does not contain %s: %s", want, out)
+		}
+	}
+
+	merged := h.graphDefinition(h.Plugin.(MetricsPlugin))
+	if !merged["cmd"].Metrics[0].Diff {
+		t.Error("override should keep Diff of the built-in metric")
+	}
+	if builtin["cmd"].Metrics[0].Label != "Get" {
+		t.Error("override should not modify the built-in definition")
+	}
+}
+
+func TestLoadGraphDefinitionError(t *testing.T) {
+	if _, err := LoadGraphDefinition(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestValidateGraphDefReader(t *testing.T) {
+	valid := `{"cmd": {"label": "Command", "unit": "integer", "metrics": [{"name": "cmd_get"}]}}`
+	buf := &bytes.Buffer{}
+	if err := ValidateGraphDefReader(strings.NewReader(valid), buf); err != nil {
+		t.Fatalf("valid definition: %v", err)
+	}
+	if !strings.Contains(buf.String(), "\n    \"label\": \"Command\",\n") {
+		t.Errorf("expected pretty-printed definition, got %s", buf.String())
+	}
+
+	invalid := `{"b": {"metrics": []}, "a": {"metrics": [{"label": "no name"}]}}`
+	buf.Reset()
+	err := ValidateGraphDefReader(strings.NewReader(invalid), buf)
+	errs, ok := err.(GraphDefErrors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("expected 2 GraphDefErrors, got %#v", err)
+	}
+	want := "graph \"a\": metric with empty name\ngraph \"b\": no metrics\n"
+	if buf.String() != want {
+		t.Errorf("reported errors = %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	if err := ValidateGraphDefReader(strings.NewReader("{not json"), buf); err == nil {
+		t.Error("expected decode error")
+	}
+}
+
+func TestValidateGraphDefUnit(t *testing.T) {
+	defs := map[string]Graphs{
+		"mem":  {Unit: "byte", Metrics: []Metrics{{Name: "used"}}},
+		"cpu":  {Unit: UnitPercentage, Metrics: []Metrics{{Name: "user"}}},
+		"load": {Metrics: []Metrics{{Name: "load1"}}},
+	}
+	err := ValidateGraphDef(defs)
+	errs, ok := err.(GraphDefErrors)
+	if !ok || len(errs) != 1 || errs[0].Graph != "mem" {
+		t.Fatalf("expected one error for graph mem, got %v", err)
+	}
+	if want := `graph "mem": unknown unit "byte"`; errs[0].Error() != want {
+		t.Errorf("got %q, want %q", errs[0].Error(), want)
+	}
+}
+
+func TestValidateGraphDefDuplicates(t *testing.T) {
+	defs := map[string]Graphs{
+		"cmd":        {Metrics: []Metrics{{Name: "cmd_get"}, {Name: "cmd_set"}, {Name: "cmd_get"}}},
+		"conn":       {Metrics: []Metrics{{Name: "total.opened"}}},
+		"conn.total": {Metrics: []Metrics{{Name: "opened"}, {Name: "closed"}}},
+	}
+	err := ValidateGraphDef(defs)
+	errs, ok := err.(GraphDefErrors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("expected 2 GraphDefErrors, got %v", err)
+	}
+	want := []string{
+		`graph "cmd": metric "cmd_get": duplicate metric name`,
+		`graph "conn.total": metric "opened": same output name "conn.total.opened" as graph "conn"`,
+	}
+	for i, e := range errs {
+		if e.Error() != want[i] {
+			t.Errorf("error %d = %q, want %q", i, e.Error(), want[i])
+		}
+	}
+}
+
+func TestGraphDefinitionHash(t *testing.T) {
+	hash := func(graphs map[string]Graphs) string {
+		t.Helper()
+		h := NewIdpcPlugin(testMetricsPlugin{key: "test", graphs: graphs})
+		sum, err := h.GraphDefinitionHash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sum
+	}
+	base := hash(manyGraphs(100))
+	if len(base) != 64 {
+		t.Fatalf("unexpected digest %q", base)
+	}
+	for i := 0; i < 10; i++ {
+		// map iteration order differs between calls
+		if got := hash(manyGraphs(100)); got != base {
+			t.Fatalf("hash is not stable: %s != %s", got, base)
+		}
+	}
+
+	changed := manyGraphs(100)
+	g := changed["graph42"]
+	g.Metrics = append([]Metrics(nil), g.Metrics...)
+	g.Metrics[0].Label = "Changed"
+	changed["graph42"] = g
+	if hash(changed) == base {
+		t.Error("hash should change when a label changes")
+	}
+
+	changed = manyGraphs(100)
+	changed["graph42"].Metrics[0].Diff = true
+	if hash(changed) == base {
+		t.Error("hash should change when Diff changes")
+	}
+
+	// the digest only covers the documented fields and skips zero values,
+	// so it must not change when Metrics gains new fields
+	pinned := map[string]Graphs{
+		"mem": {Label: "Memory", Unit: UnitBytes, Metrics: []Metrics{
+			{Name: "used", Label: "Used"},
+			{Name: "evicted", Diff: true, Min: Bound(0)},
+		}},
+	}
+	want := "0a28b2513cb1c25e26cb0de7394ff0583b76b74b78a6f458f83a1691c81d944e"
+	if got := hash(pinned); got != want {
+		t.Errorf("hash = %s, want %s", got, want)
+	}
+	pinned["mem"].Metrics[1].Min = nil
+	if hash(pinned) == want {
+		t.Error("hash should tell a zero bound from no bound")
+	}
+}
+
+func TestSelectGraphs(t *testing.T) {
+	p := testMetricsPlugin{
+		key: "test",
+		graphs: map[string]Graphs{
+			"foo": {Unit: UnitInteger, Metrics: []Metrics{{Name: "foo_a"}}},
+			"bar": {Unit: UnitInteger, Metrics: []Metrics{{Name: "bar_a"}}},
+		},
+		values: map[string]interface{}{"foo_a": uint64(1), "bar_a": uint64(2)},
+	}
+	h := NewIdpcPlugin(p)
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	h.SelectGraphs = []string{"foo"}
+
+	meta := &bytes.Buffer{}
+	h.writeMeta(meta)
+	if !strings.Contains(meta.String(), `"test.foo"`) || strings.Contains(meta.String(), "bar") {
+		t.Errorf("meta should only define the foo graph: %s", meta.String())
+	}
+
+	out := &bytes.Buffer{}
+	if err := h.writeMetricsValues(out, p); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "test.foo.foo_a\t1\t") || strings.Count(out.String(), "\n") != 1 {
+		t.Errorf("only foo metrics should be emitted: %q", out.String())
+	}
+}
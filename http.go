@@ -0,0 +1,78 @@
+package plugin
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// ServeHTTP 启动HTTP服务，将插件作为拉取目标：
+// /metrics 按需采集并以 Format 指定的格式输出指标值，/healthz 用于健康检查。
+// 设置了 PprofAddr 时在服务运行期间同时在该地址提供 net/http/pprof(需要使用 -tags pprof 构建)
+func (h *IdpcPlugin) ServeHTTP(addr string) error {
+	if h.PprofAddr != "" {
+		stop, err := servePprof(h.PprofAddr)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+	return http.ListenAndServe(addr, h.Handler())
+}
+
+// Handler 返回 ServeHTTP 使用的 http.Handler
+func (h *IdpcPlugin) Handler() http.Handler {
+	// 状态文件在两次采集之间共享，同一时间只允许一次采集
+	var mu sync.Mutex
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		mp, ok := h.Plugin.(MetricsPlugin)
+		if !ok {
+			http.Error(w, "not a metrics plugin", http.StatusNotFound)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		var buf bytes.Buffer
+		var err error
+		switch h.Format {
+		case FormatJSON:
+			err = h.OutputMetricsValuesJSON(&buf)
+		case FormatPrometheus:
+			err = h.OutputPrometheus(&buf)
+		case FormatInflux:
+			err = h.OutputMetricsValuesInflux(&buf, h.Plugin.Meta().Key, nil)
+		default:
+			err = h.writeMetricsValues(&buf, mp)
+		}
+		if err != nil {
+			h.logger().Error().Err(err).Msg("ServeHTTP: ")
+			code := http.StatusInternalServerError
+			if errors.Is(err, ErrCollectTimeout) {
+				code = http.StatusGatewayTimeout
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		w.Header().Set("Content-Type", contentType(h.Format))
+		buf.WriteTo(w)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, "ok\n")
+	})
+	return mux
+}
+
+// contentType 返回输出格式对应的Content-Type
+func contentType(format string) string {
+	switch format {
+	case FormatJSON:
+		return "application/json"
+	case FormatPrometheus:
+		return "text/plain; version=0.0.4; charset=utf-8"
+	}
+	return "text/plain; charset=utf-8"
+}
@@ -0,0 +1,112 @@
+package plugin
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"g": {Metrics: []Metrics{{Name: "value"}}}},
+		values: map[string]interface{}{"value": 1.5},
+	})
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	h.Timeout = time.Second
+	ts := httptest.NewServer(h.Handler())
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("/metrics status = %d: %s", res.StatusCode, body)
+	}
+	if !regexp.MustCompile(`^test\.g\.value\t1\.500000\t\d+\n$`).Match(body) {
+		t.Errorf("unexpected /metrics body: %q", body)
+	}
+
+	res, err = http.Get(ts.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("/healthz status = %d", res.StatusCode)
+	}
+}
+
+func TestHandlerFormat(t *testing.T) {
+	for _, tc := range []struct {
+		format      string
+		contentType string
+		body        string
+	}{
+		{"", "text/plain; charset=utf-8", `^test\.g\.value\t1\.500000\t\d+\n$`},
+		{FormatJSON, "application/json", `^\[\{"name":"test\.g\.value","value":1\.5,"time":\d+\}\]\n$`},
+		{FormatPrometheus, "text/plain; version=0.0.4; charset=utf-8", `(?m)^test_g_value 1\.5$`},
+		{FormatInflux, "text/plain; charset=utf-8", `^test test\.g\.value=1\.5 \d+\n$`},
+	} {
+		h := NewIdpcPlugin(testMetricsPlugin{
+			key:    "test",
+			graphs: map[string]Graphs{"g": {Metrics: []Metrics{{Name: "value"}}}},
+			values: map[string]interface{}{"value": 1.5},
+		})
+		h.TempFile = filepath.Join(t.TempDir(), "state")
+		h.Format = tc.format
+		ts := httptest.NewServer(h.Handler())
+		res, err := http.Get(ts.URL + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		ts.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("format %q: /metrics status = %d: %s", tc.format, res.StatusCode, body)
+		}
+		if got := res.Header.Get("Content-Type"); got != tc.contentType {
+			t.Errorf("format %q: Content-Type = %q, want %q", tc.format, got, tc.contentType)
+		}
+		if !regexp.MustCompile(tc.body).Match(body) {
+			t.Errorf("format %q: unexpected /metrics body: %q", tc.format, body)
+		}
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test", delay: time.Second})
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	h.Timeout = 10 * time.Millisecond
+	ts := httptest.NewServer(h.Handler())
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("/metrics status = %d, want %d", res.StatusCode, http.StatusGatewayTimeout)
+	}
+}
+
+// freeAddr returns a local address that is free to listen on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
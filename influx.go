@@ -0,0 +1,129 @@
+package plugin
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FormatInflux 以InfluxDB line protocol输出指标值，measurement为插件的key，见 IdpcPlugin.Format
+const FormatInflux = "influx"
+
+var (
+	influxMeasurementReplacer = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxKeyReplacer         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// OutputMetricsValuesInflux 采集指标并以InfluxDB line protocol输出，
+// 所有指标作为measurement的字段，格式为 measurement,tag=value name=value timestamp，
+// 时间戳为纳秒，时间不同的指标(见 Metrics.TimestampOffset)分别输出一行。
+// 构建信息(见 BuildInfo)和 ConstMetrics 各自输出一行，Label作为额外的tag，与tags同名时使用Label的值
+func (h *IdpcPlugin) OutputMetricsValuesInflux(w io.Writer, measurement string, tags map[string]string) error {
+	mp, ok := h.Plugin.(MetricsPlugin)
+	if !ok {
+		return errNotMetricsPlugin
+	}
+	groups, now, err := h.collectValues(mp)
+	if err != nil && !isSkip(err) {
+		return err
+	}
+	if err != nil {
+		h.logger().Debug().Err(err).Msg("OutputMetricsValuesInflux: ")
+	}
+
+	var times []int64
+	fields := make(map[int64][]string)
+	for _, g := range groups {
+		for _, line := range g.lines {
+			if !h.validValue(line.Name, line.Value) {
+				continue
+			}
+			value, ok := influxValue(line.Value)
+			if !ok {
+				h.logger().Warn().Msgf("OutputMetricsValuesInflux: unsupported value type %T for %s, skipped", line.Value, line.Name)
+				continue
+			}
+			ts := line.Time.UnixNano()
+			if _, ok := fields[ts]; !ok {
+				times = append(times, ts)
+			}
+			fields[ts] = append(fields[ts], influxKeyReplacer.Replace(line.Name)+"="+value)
+		}
+	}
+
+	prefix := influxMeasurementReplacer.Replace(measurement) + influxTags(tags)
+	bw := bufio.NewWriter(w)
+	for _, ts := range times {
+		bw.WriteString(prefix)
+		bw.WriteString(" ")
+		bw.WriteString(strings.Join(fields[ts], ","))
+		bw.WriteString(" ")
+		bw.WriteString(strconv.FormatInt(ts, 10))
+		bw.WriteString("\n")
+	}
+	for _, line := range h.infoLines(now) {
+		if !h.validValue(line.Name, line.Value) {
+			continue
+		}
+		value, ok := influxValue(line.Value)
+		if !ok {
+			continue
+		}
+		lineTags := make(map[string]string, len(tags)+len(line.labels))
+		for k, v := range tags {
+			lineTags[k] = v
+		}
+		for _, l := range line.labels {
+			lineTags[l.Name] = l.Value
+		}
+		bw.WriteString(influxMeasurementReplacer.Replace(measurement) + influxTags(lineTags))
+		bw.WriteString(" ")
+		bw.WriteString(influxKeyReplacer.Replace(line.Name) + "=" + value)
+		bw.WriteString(" ")
+		bw.WriteString(strconv.FormatInt(line.Time.UnixNano(), 10))
+		bw.WriteString("\n")
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	h.feedSink(groups)
+	return nil
+}
+
+// influxTags 返回按key排序并转义后的标签，格式为 ,key=value,...
+func influxTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(",")
+		b.WriteString(influxKeyReplacer.Replace(k))
+		b.WriteString("=")
+		b.WriteString(influxKeyReplacer.Replace(tags[k]))
+	}
+	return b.String()
+}
+
+// influxValue 整数以 "i" 后缀输出，超出int64范围的uint64按浮点数输出，不支持的类型返回false
+func influxValue(value interface{}) (string, bool) {
+	switch v := normalizeValue(value).(type) {
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10) + "i", true
+	case uint64:
+		if v <= math.MaxInt64 {
+			return strconv.FormatUint(v, 10) + "i", true
+		}
+		return strconv.FormatFloat(float64(v), 'g', -1, 64), true
+	case int64:
+		return strconv.FormatInt(v, 10) + "i", true
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), true
+	}
+	return "", false
+}
@@ -0,0 +1,101 @@
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInfluxEscaping(t *testing.T) {
+	tags := map[string]string{"host name": "web,01", "role": "a=b", "dc": "east"}
+	if got, want := influxTags(tags), `,dc=east,host\ name=web\,01,role=a\=b`; got != want {
+		t.Errorf("influxTags = %q, want %q", got, want)
+	}
+	if got := influxTags(nil); got != "" {
+		t.Errorf("influxTags(nil) = %q", got)
+	}
+	if got, want := influxMeasurementReplacer.Replace("my measurement,x=y"), `my\ measurement\,x=y`; got != want {
+		t.Errorf("measurement = %q, want %q", got, want)
+	}
+}
+
+func TestInfluxValue(t *testing.T) {
+	for _, tc := range []struct {
+		value interface{}
+		want  string
+	}{
+		{1.5, "1.5"},
+		{float64(3), "3"},
+		{uint32(7), "7i"},
+		{uint64(42), "42i"},
+		{uint64(math.MaxUint64), "1.8446744073709552e+19"},
+		{int64(-3), "-3i"},
+		{7, "7i"},
+	} {
+		if got, ok := influxValue(tc.value); got != tc.want || !ok {
+			t.Errorf("influxValue(%T %v) = %q, %v, want %q", tc.value, tc.value, got, ok, tc.want)
+		}
+	}
+	if got, ok := influxValue([]int{1}); ok {
+		t.Errorf("influxValue of an unsupported type = %q, want skipped", got)
+	}
+}
+
+func TestOutputMetricsValuesInflux(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{
+		key: "test",
+		graphs: map[string]Graphs{
+			"mem": {Metrics: []Metrics{
+				{Name: "used"},
+				{Name: "free space"},
+				{Name: "count", Type: metricTypeUint64},
+				{Name: "old", TimestampOffset: time.Minute},
+				{Name: "bad", Scale: 10},
+			}},
+		},
+		values: map[string]interface{}{"used": 1.5, "free space": 2.0, "count": uint64(3), "old": 4.0, "bad": math.MaxFloat64},
+	})
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	buf := &bytes.Buffer{}
+	if err := h.OutputMetricsValuesInflux(buf, "idpc", map[string]string{"host": "a b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	fields := strings.Fields(strings.SplitN(buf.String(), "\n", 2)[0])
+	ts, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	if err != nil {
+		t.Fatalf("%v: %q", err, buf.String())
+	}
+	old := time.Unix(0, ts).Add(-time.Minute).UnixNano()
+	want := fmt.Sprintf("idpc,host=a\\ b test.mem.used=1.5,test.mem.free\\ space=2,test.mem.count=3i %d\n"+
+		"idpc,host=a\\ b test.mem.old=4 %d\n", ts, old)
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestOutputMetricsValuesInfluxInfo(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test", values: map[string]interface{}{}})
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	testClock(&h)
+	h.BuildInfo = true
+	h.ConstMetrics = []ConstMetric{
+		{Name: "config", Value: 1, Labels: []Label{{Name: "mode", Value: "replica set"}, {Name: "host", Value: "b"}}},
+	}
+	buf := &bytes.Buffer{}
+	if err := h.OutputMetricsValuesInflux(buf, "idpc", map[string]string{"host": "a"}); err != nil {
+		t.Fatal(err)
+	}
+	ts := h.now().UnixNano()
+	want := fmt.Sprintf("idpc,go_version=%s,goarch=%s,goos=%s,host=a,revision=test,version=1.0.0 test.plugin.build_info=1i %d\n"+
+		"idpc,host=b,mode=replica\\ set test.config=1 %d\n", runtime.Version(), runtime.GOARCH, runtime.GOOS, ts, ts)
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
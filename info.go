@@ -0,0 +1,100 @@
+package plugin
+
+import (
+	"io"
+	"strings"
+	"time"
+)
+
+// Label 指标标签，支持标签的输出格式直接附加标签，
+// 制表符分隔格式按照Graphite标签语法编码到名称中，例如 name;key=value
+type Label struct {
+	Name  string
+	Value string
+}
+
+var labelValueReplacer = strings.NewReplacer(";", "_", "~", "_", "\t", "_", " ", "_")
+
+// labeledName 将标签编码到指标名称中
+func labeledName(name string, labels []Label) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, l := range labels {
+		b.WriteString(";")
+		b.WriteString(l.Name)
+		b.WriteString("=")
+		b.WriteString(labelValueReplacer.Replace(l.Value))
+	}
+	return b.String()
+}
+
+// buildInfoLabels 返回插件构建信息的标签
+func (h *IdpcPlugin) buildInfoLabels() []Label {
+	meta := h.displayMeta()
+	return []Label{
+		{Name: "version", Value: meta.Version.String()},
+		{Name: "revision", Value: meta.Revision},
+		{Name: "go_version", Value: meta.GOVersion},
+		{Name: "goos", Value: meta.GOOS},
+		{Name: "goarch", Value: meta.GOARCH},
+	}
+}
+
+// buildInfoLine 返回值为1的 key.plugin.build_info 指标，构建信息作为标签
+func (h *IdpcPlugin) buildInfoLine(now time.Time) MetricLine {
+	return MetricLine{
+		Name:   h.metricName(h.Plugin.Meta().Key + ".plugin.build_info"),
+		Value:  uint64(1),
+		Time:   now,
+		help:   "Plugin build information",
+		labels: h.buildInfoLabels(),
+	}
+}
+
+// printBuildInfo 输出 key.plugin.build_info 指标
+func (h *IdpcPlugin) printBuildInfo(w io.Writer, now time.Time) {
+	h.printLabeledLine(w, h.buildInfoLine(now))
+}
+
+// printLabeledLine 输出标签编码到名称中的指标
+func (h *IdpcPlugin) printLabeledLine(w io.Writer, line MetricLine) {
+	h.printValue(w, labeledName(line.Name, line.labels), line.Value, line.Time)
+}
+
+// ConstMetric 每次运行都输出的常量指标，例如携带配置信息标签的值为1的指标
+type ConstMetric struct {
+	// Name 插件key之后的指标名称，输出为 key.Name
+	Name   string
+	Value  float64
+	Labels []Label
+}
+
+// constLines 返回 ConstMetrics 的指标
+func (h *IdpcPlugin) constLines(now time.Time) []MetricLine {
+	key := h.Plugin.Meta().Key
+	lines := make([]MetricLine, 0, len(h.ConstMetrics))
+	for _, m := range h.ConstMetrics {
+		lines = append(lines, MetricLine{Name: h.metricName(key + "." + m.Name), Value: m.Value, Time: now, labels: m.Labels})
+	}
+	return lines
+}
+
+// printConstMetrics 输出 ConstMetrics
+func (h *IdpcPlugin) printConstMetrics(w io.Writer, now time.Time) {
+	for _, line := range h.constLines(now) {
+		h.printLabeledLine(w, line)
+	}
+}
+
+// infoLines 返回支持标签的输出格式附加输出的指标：设置了 BuildInfo 时的构建信息和 ConstMetrics。
+// now为零值(跳过了本次采集)时使用当前时间
+func (h *IdpcPlugin) infoLines(now time.Time) []MetricLine {
+	if now.IsZero() {
+		now = h.now()
+	}
+	var lines []MetricLine
+	if h.BuildInfo {
+		lines = append(lines, h.buildInfoLine(now))
+	}
+	return append(lines, h.constLines(now)...)
+}
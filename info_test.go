@@ -0,0 +1,59 @@
+package plugin
+
+import (
+	"bytes"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestBuildInfo(t *testing.T) {
+	p := testMetricsPlugin{key: "test", values: map[string]interface{}{}}
+	h := NewIdpcPlugin(p)
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	h.BuildInfo = true
+	buf := &bytes.Buffer{}
+	if err := h.writeMetricsValues(buf, p); err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Split(strings.TrimSpace(buf.String()), "\t")
+	if len(fields) != 3 || fields[1] != "1" {
+		t.Fatalf("unexpected build info line: %q", buf.String())
+	}
+	want := "test.plugin.build_info;version=1.0.0;revision=test;go_version=" + runtime.Version() +
+		";goos=" + runtime.GOOS + ";goarch=" + runtime.GOARCH
+	if fields[0] != want {
+		t.Errorf("build info name = %q, want %q", fields[0], want)
+	}
+}
+
+func TestLabeledName(t *testing.T) {
+	got := labeledName("a.b", []Label{{"k", "v 1;x"}, {"e", ""}})
+	if want := "a.b;k=v_1_x;e="; got != want {
+		t.Errorf("labeledName = %q, want %q", got, want)
+	}
+}
+
+func TestConstMetrics(t *testing.T) {
+	p := testMetricsPlugin{key: "test", values: map[string]interface{}{}}
+	h := NewIdpcPlugin(p)
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	h.ConstMetrics = []ConstMetric{
+		{Name: "config", Value: 1, Labels: []Label{{Name: "mode", Value: "replica"}}},
+		{Name: "shards", Value: 4},
+	}
+	// the second run is within a second of the first and skips collection
+	for run := 1; run <= 2; run++ {
+		buf := &bytes.Buffer{}
+		if err := h.writeMetricsValues(buf, p); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != 2 ||
+			!strings.HasPrefix(lines[0], "test.config;mode=replica\t1.000000\t") ||
+			!strings.HasPrefix(lines[1], "test.shards\t4.000000\t") {
+			t.Errorf("run %d: unexpected const metrics %q", run, buf.String())
+		}
+	}
+}
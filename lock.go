@@ -0,0 +1,64 @@
+package plugin
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// LockMode 状态文件的加锁方式，用于防止同一插件的多个实例同时读写状态文件
+type LockMode int
+
+const (
+	// LockNone 不加锁(默认)
+	LockNone LockMode = iota
+	// LockBlock 等待其他实例释放锁，设置了 IdpcPlugin.LockTimeout 时最多等待 LockTimeout
+	LockBlock
+	// LockSkip 锁被其他实例持有时跳过本次运行
+	LockSkip
+)
+
+// ErrStateLocked 在 LockSkip 模式下状态文件被其他实例锁定，或 LockBlock 模式下等待超过 LockTimeout 时返回
+var ErrStateLocked = errors.New("state file is locked by another instance")
+
+// lockState 根据 StateLock 获取状态文件的锁，返回释放锁的函数。
+// 已经持有锁时直接返回，使 writeMetricsValues 可以在持有锁期间调用 LoadLastValues 和 SaveValues
+func (h *IdpcPlugin) lockState() (unlock func(), err error) {
+	if h.StateLock == LockNone || h.stateLock != nil {
+		return func() {}, nil
+	}
+	f, err := os.OpenFile(h.tempFilename()+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = h.acquireLock(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	h.stateLock = f
+	return func() {
+		unlockFile(f)
+		f.Close()
+		h.stateLock = nil
+	}, nil
+}
+
+// lockPollInterval 设置了 LockTimeout 时重试加锁的间隔
+const lockPollInterval = 10 * time.Millisecond
+
+// acquireLock 对f加锁，LockBlock 模式下设置了 LockTimeout 时以非阻塞方式重试，
+// 超过 LockTimeout 仍未获得锁时返回 ErrStateLocked
+func (h *IdpcPlugin) acquireLock(f *os.File) error {
+	if h.StateLock != LockBlock || h.LockTimeout <= 0 {
+		return lockFile(f, h.StateLock == LockBlock)
+	}
+	deadline := time.Now().Add(h.LockTimeout)
+	for {
+		err := lockFile(f, false)
+		if err != ErrStateLocked || !time.Now().Before(deadline) {
+			return err
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
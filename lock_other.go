@@ -0,0 +1,16 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package plugin
+
+import "os"
+
+// 不支持文件锁的平台上不加锁
+
+func lockFile(f *os.File, block bool) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
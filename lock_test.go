@@ -0,0 +1,123 @@
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStateLockConcurrent(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "state")
+	values := make(map[string]interface{})
+	for i := 0; i < 2000; i++ {
+		values[fmt.Sprintf("metric_%d", i)] = float64(i)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+			h.TempFile = tempFile
+			h.StateLock = LockBlock
+			for j := 0; j < 20; j++ {
+				v := make(map[string]interface{}, len(values))
+				for k, val := range values {
+					v[k] = val
+				}
+				if err := h.SaveValues(PluginValues{Values: v, Timestamp: time.Now()}); err != nil {
+					errs <- err
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+			h.TempFile = tempFile
+			h.StateLock = LockBlock
+			for j := 0; j < 20; j++ {
+				last, err := h.LoadLastValues()
+				if err != nil {
+					errs <- err
+					continue
+				}
+				// the file is either missing yet or complete
+				if n := len(last.Values); n != 0 && n != len(values)+1 {
+					errs <- fmt.Errorf("loaded %d values", n)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestStateLockSkip(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "state")
+	holder := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	holder.TempFile = tempFile
+	holder.StateLock = LockBlock
+	unlock, err := holder.lockState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"": {Metrics: []Metrics{{Name: "value"}}}},
+		values: map[string]interface{}{"value": 1.0},
+	}
+	h := NewIdpcPlugin(p)
+	h.TempFile = tempFile
+	h.StateLock = LockSkip
+	if _, err := h.LoadLastValues(); err != ErrStateLocked {
+		t.Errorf("LoadLastValues error = %v, want ErrStateLocked", err)
+	}
+	buf := &bytes.Buffer{}
+	if err := h.writeMetricsValues(buf, p); err != nil || buf.Len() != 0 {
+		t.Errorf("locked run should be skipped, got %q, %v", buf.String(), err)
+	}
+
+	unlock()
+	if err := h.writeMetricsValues(buf, p); err != nil || buf.Len() == 0 {
+		t.Errorf("unlocked run should emit, got %q, %v", buf.String(), err)
+	}
+}
+
+func TestStateLockTimeout(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "state")
+	holder := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	holder.TempFile = tempFile
+	holder.StateLock = LockBlock
+	unlock, err := holder.lockState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	h.TempFile = tempFile
+	h.StateLock = LockBlock
+	h.LockTimeout = 50 * time.Millisecond
+	start := time.Now()
+	if _, err := h.LoadLastValues(); err != ErrStateLocked {
+		t.Errorf("LoadLastValues error = %v, want ErrStateLocked", err)
+	}
+	if elapsed := time.Since(start); elapsed < h.LockTimeout {
+		t.Errorf("gave up after %s, want at least %s", elapsed, h.LockTimeout)
+	}
+
+	// the lock is released while waiting
+	h.LockTimeout = 5 * time.Second
+	time.AfterFunc(50*time.Millisecond, unlock)
+	if _, err := h.LoadLastValues(); err != nil {
+		t.Errorf("LoadLastValues should get the released lock, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package plugin
+
+import (
+	"strings"
+	"unicode"
+)
+
+// NameStyle 指标名称的命名风格
+type NameStyle int
+
+const (
+	// NameStyleSnake 例如 cmd_get
+	NameStyleSnake NameStyle = iota
+	// NameStyleKebab 例如 cmd-get
+	NameStyleKebab
+	// NameStyleDot 例如 cmd.get
+	NameStyleDot
+)
+
+func (s NameStyle) separator() string {
+	switch s {
+	case NameStyleKebab:
+		return "-"
+	case NameStyleDot:
+		return "."
+	default:
+		return "_"
+	}
+}
+
+// NormalizeName 将任意风格(snake_case、kebab-case、dot.case、camelCase)的名称
+// 转换为style指定的小写风格，例如 "cmdGet" 转换为 "cmd_get"
+func NormalizeName(name string, style NameStyle) string {
+	return strings.Join(splitWords(name), style.separator())
+}
+
+// splitWords 按分隔符和大小写边界将名称拆分为小写单词，连续的大写字母视为一个单词
+func splitWords(name string) []string {
+	var words []string
+	var word []rune
+	flush := func() {
+		if len(word) > 0 {
+			words = append(words, strings.ToLower(string(word)))
+			word = word[:0]
+		}
+	}
+	runes := []rune(name)
+	for i, r := range runes {
+		switch {
+		case r == '_' || r == '-' || r == '.' || unicode.IsSpace(r):
+			flush()
+			continue
+		case unicode.IsUpper(r) && i > 0:
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				flush()
+			}
+		}
+		word = append(word, r)
+	}
+	flush()
+	return words
+}
+
+// metricName 对输出的指标名称应用 NameTransform
+func (h *IdpcPlugin) metricName(name string) string {
+	if h.NameTransform == nil {
+		return name
+	}
+	return h.NameTransform(name)
+}
+
+// unitSuffixes 单位对应的名称后缀，无量纲的单位没有后缀
+var unitSuffixes = map[string]string{
+	UnitFloat:          "",
+	UnitInteger:        "",
+	UnitPercentage:     "_percent",
+	UnitBytes:          "_bytes",
+	UnitBytesPerSecond: "_bytes_per_second",
+	UnitIOPS:           "_iops",
+}
+
+// unitSuffix 返回 UnitSuffix 开启时追加到指标名称后的单位后缀
+func (h *IdpcPlugin) unitSuffix(unit string) string {
+	if !h.UnitSuffix || unit == "" {
+		return ""
+	}
+	if suffix, ok := unitSuffixes[unit]; ok {
+		return suffix
+	}
+	return "_" + NormalizeName(unit, NameStyleSnake)
+}
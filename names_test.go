@@ -0,0 +1,97 @@
+package plugin
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeName(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		snake, kebab, dot string
+	}{
+		{"cmd_get", "cmd_get", "cmd-get", "cmd.get"},
+		{"cmdGet", "cmd_get", "cmd-get", "cmd.get"},
+		{"Cmd-Get", "cmd_get", "cmd-get", "cmd.get"},
+		{"bytes.read_Total", "bytes_read_total", "bytes-read-total", "bytes.read.total"},
+		{"HTTPRequests2xx", "http_requests2xx", "http-requests2xx", "http.requests2xx"},
+		{"disk0ReadBytes", "disk0_read_bytes", "disk0-read-bytes", "disk0.read.bytes"},
+		{"__leading..and--trailing__", "leading_and_trailing", "leading-and-trailing", "leading.and.trailing"},
+	} {
+		if got := NormalizeName(tc.name, NameStyleSnake); got != tc.snake {
+			t.Errorf("NormalizeName(%q, snake) = %q, want %q", tc.name, got, tc.snake)
+		}
+		if got := NormalizeName(tc.name, NameStyleKebab); got != tc.kebab {
+			t.Errorf("NormalizeName(%q, kebab) = %q, want %q", tc.name, got, tc.kebab)
+		}
+		if got := NormalizeName(tc.name, NameStyleDot); got != tc.dot {
+			t.Errorf("NormalizeName(%q, dot) = %q, want %q", tc.name, got, tc.dot)
+		}
+	}
+}
+
+func TestNameTransform(t *testing.T) {
+	p := testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"memCmd": {Metrics: []Metrics{{Name: "cmdGet"}}}},
+		values: map[string]interface{}{"cmdGet": 1.0},
+	}
+	h := NewIdpcPlugin(p)
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	h.NameTransform = func(name string) string { return NormalizeName(name, NameStyleDot) }
+	buf := &bytes.Buffer{}
+	if err := h.writeMetricsValues(buf, p); err != nil {
+		t.Fatal(err)
+	}
+	if want := "test.mem.cmd.cmd.get\t1.000000\t"; !strings.HasPrefix(buf.String(), want) {
+		t.Errorf("got %q, want prefix %q", buf.String(), want)
+	}
+}
+
+func TestUnitSuffix(t *testing.T) {
+	p := testMetricsPlugin{
+		key: "test",
+		graphs: map[string]Graphs{
+			"bytes": {Unit: UnitBytes, Metrics: []Metrics{{Name: "bytes_read", Diff: true}}},
+			"rate":  {Unit: UnitBytesPerSecond, Metrics: []Metrics{{Name: "rate"}}},
+			"count": {Unit: UnitInteger, Metrics: []Metrics{{Name: "count"}}},
+			"temp":  {Unit: "Celsius", Metrics: []Metrics{{Name: "temp"}}},
+		},
+		values: map[string]interface{}{"bytes_read": 100.0, "rate": 1.0, "count": 2.0, "temp": 3.0},
+	}
+	h := NewIdpcPlugin(p)
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	h.UnitSuffix = true
+	h.NameTransform = func(name string) string { return NormalizeName(name, NameStyleKebab) }
+	advance := testClock(&h)
+	buf := &bytes.Buffer{}
+	if err := h.writeMetricsValues(buf, p); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"test-rate-rate-bytes-per-second\t", "test-count-count\t", "test-temp-temp-celsius\t"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("output does not contain %q: %q", want, buf.String())
+		}
+	}
+
+	// state keeps the unsuffixed names so diffs still work
+	last, err := h.LoadLastValues()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := last.Values["bytes_read"]; !ok {
+		t.Errorf("state should use unsuffixed names: %v", last.Values)
+	}
+	advance(time.Minute)
+	p.values["bytes_read"] = 160.0
+	buf.Reset()
+	if err := h.writeMetricsValues(buf, p); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "test-bytes-bytes-read-bytes\t60.000000\t") {
+		t.Errorf("diff of suffixed metric missing: %q", buf.String())
+	}
+}
@@ -0,0 +1,112 @@
+package plugin
+
+import (
+	"encoding/json"
+	"io"
+)
+
+type groupedGraph struct {
+	Label   string                   `json:"label"`
+	Unit    string                   `json:"unit"`
+	Metrics map[string]groupedMetric `json:"metrics"`
+}
+
+type groupedMetric struct {
+	Value interface{} `json:"value"`
+	Time  int64       `json:"time"`
+}
+
+// OutputGroupedJSON 采集指标并按图表分组输出JSON，格式为
+// {"key.graph":{"label":...,"unit":...,"metrics":{"key.graph.name":{"value":...,"time":...}}}}
+func (h *IdpcPlugin) OutputGroupedJSON(w io.Writer) error {
+	mp, ok := h.Plugin.(MetricsPlugin)
+	if !ok {
+		return errNotMetricsPlugin
+	}
+	groups, _, err := h.collectValues(mp)
+	if err != nil && !isSkip(err) {
+		return err
+	}
+	if err != nil {
+		h.logger().Debug().Err(err).Msg("OutputGroupedJSON: ")
+	}
+
+	out := make(map[string]groupedGraph, len(groups))
+	for _, g := range groups {
+		name := h.graphName(g.key)
+		gg := groupedGraph{
+			Label:   g.graph.Label,
+			Unit:    g.graph.Unit,
+			Metrics: make(map[string]groupedMetric, len(g.lines)),
+		}
+		if gg.Label == "" {
+			gg.Label = title(name)
+		}
+		for _, line := range g.lines {
+			if !h.validValue(line.Name, line.Value) {
+				continue
+			}
+			gg.Metrics[line.Name] = groupedMetric{Value: line.Value, Time: line.Time.Unix()}
+		}
+		out[name] = gg
+	}
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		return err
+	}
+	h.feedSink(groups)
+	return nil
+}
+
+type metricValue struct {
+	Name   string            `json:"name"`
+	Value  interface{}       `json:"value"`
+	Time   int64             `json:"time"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// OutputMetricsValuesJSON 采集指标并以JSON数组输出，格式为 [{"name":...,"value":...,"time":...}]，
+// 计算过程与 OutputMetricsValues 相同，NaN和Inf值同样被丢弃。
+// 构建信息(见 BuildInfo)和 ConstMetrics 在最后输出，Label作为 "labels" 对象
+func (h *IdpcPlugin) OutputMetricsValuesJSON(w io.Writer) error {
+	mp, ok := h.Plugin.(MetricsPlugin)
+	if !ok {
+		return errNotMetricsPlugin
+	}
+	groups, now, err := h.collectValues(mp)
+	if err != nil && !isSkip(err) {
+		return err
+	}
+	if err != nil {
+		h.logger().Debug().Err(err).Msg("OutputMetricsValuesJSON: ")
+	}
+
+	out := []metricValue{}
+	for _, g := range groups {
+		for _, lines := range [][]MetricLine{g.backfill, g.lines} {
+			for _, line := range lines {
+				if !h.validValue(line.Name, line.Value) {
+					continue
+				}
+				out = append(out, metricValue{Name: line.Name, Value: line.Value, Time: line.Time.Unix()})
+			}
+		}
+	}
+	for _, line := range h.infoLines(now) {
+		if !h.validValue(line.Name, line.Value) {
+			continue
+		}
+		v := metricValue{Name: line.Name, Value: line.Value, Time: line.Time.Unix()}
+		if len(line.labels) > 0 {
+			v.Labels = make(map[string]string, len(line.labels))
+			for _, l := range line.labels {
+				v.Labels[l.Name] = l.Value
+			}
+		}
+		out = append(out, v)
+	}
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		return err
+	}
+	h.feedSink(groups)
+	return nil
+}
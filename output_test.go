@@ -0,0 +1,121 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestOutputGroupedJSON(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{
+		key: "test",
+		graphs: map[string]Graphs{
+			"mem": {Label: "Memory", Unit: UnitBytes, Metrics: []Metrics{{Name: "used"}, {Name: "free"}}},
+			"cpu": {Unit: UnitPercentage, Metrics: []Metrics{{Name: "user"}}},
+		},
+		values: map[string]interface{}{"used": 10.0, "free": 20.0, "user": 1.5},
+	})
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	buf := &bytes.Buffer{}
+	if err := h.OutputGroupedJSON(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var out map[string]struct {
+		Label   string
+		Unit    string
+		Metrics map[string]struct {
+			Value float64
+			Time  int64
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 {
+		t.Fatalf("expected 2 graphs, got %s", buf.String())
+	}
+	mem := out["test.mem"]
+	if mem.Label != "Memory" || mem.Unit != UnitBytes || len(mem.Metrics) != 2 ||
+		mem.Metrics["test.mem.used"].Value != 10 || mem.Metrics["test.mem.free"].Value != 20 {
+		t.Errorf("unexpected mem graph: %+v", mem)
+	}
+	cpu := out["test.cpu"]
+	if cpu.Label != "Test Cpu" || len(cpu.Metrics) != 1 || cpu.Metrics["test.cpu.user"].Value != 1.5 ||
+		cpu.Metrics["test.cpu.user"].Time == 0 {
+		t.Errorf("unexpected cpu graph: %+v", cpu)
+	}
+}
+
+func TestOutputMetricsValuesJSON(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{
+		key: "test",
+		graphs: map[string]Graphs{
+			"mem": {Metrics: []Metrics{{Name: "used"}, {Name: "bad", Scale: 10}, {Name: "free", Scale: 2}}},
+		},
+		values: map[string]interface{}{"used": 10.0, "bad": math.MaxFloat64, "free": 20.0},
+	})
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	buf := &bytes.Buffer{}
+	if err := h.OutputMetricsValuesJSON(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var out []struct {
+		Name  string
+		Value float64
+		Time  int64
+	}
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 || out[0].Name != "test.mem.used" || out[0].Value != 10 ||
+		out[1].Name != "test.mem.free" || out[1].Value != 40 || out[0].Time == 0 {
+		t.Errorf("unexpected output %s", buf.String())
+	}
+}
+
+func TestOutputMetricsValuesJSONInfo(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"": {Metrics: []Metrics{{Name: "value"}}}},
+		values: map[string]interface{}{"value": 1.0},
+	})
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	h.BuildInfo = true
+	h.ConstMetrics = []ConstMetric{
+		{Name: "config", Value: 1, Labels: []Label{{Name: "mode", Value: "replica"}}},
+		{Name: "shards", Value: 4},
+	}
+	buf := &bytes.Buffer{}
+	if err := h.OutputMetricsValuesJSON(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var out []struct {
+		Name   string
+		Value  float64
+		Time   int64
+		Labels map[string]string
+	}
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 4 {
+		t.Fatalf("unexpected output %s", buf.String())
+	}
+	info := out[1]
+	if info.Name != "test.plugin.build_info" || info.Value != 1 || info.Time == 0 ||
+		info.Labels["version"] != "1.0.0" || info.Labels["revision"] != "test" || info.Labels["goos"] != runtime.GOOS {
+		t.Errorf("unexpected build info %+v", info)
+	}
+	if c := out[2]; c.Name != "test.config" || c.Value != 1 || len(c.Labels) != 1 || c.Labels["mode"] != "replica" {
+		t.Errorf("unexpected const metric %+v", c)
+	}
+	if c := out[3]; c.Name != "test.shards" || c.Value != 4 || c.Labels != nil {
+		t.Errorf("unexpected const metric %+v", c)
+	}
+}
@@ -0,0 +1,86 @@
+package plugin
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// PerfData Nagios风格的性能数据，格式为 'label'=value[unit];[warn];[crit];[min];[max]，
+// Warn/Crit/Min/Max 为nil时省略，可以使用 Bound 设置
+type PerfData struct {
+	Label string   `json:"label"`
+	Value float64  `json:"value"`
+	Unit  string   `json:"unit,omitempty"`
+	Warn  *float64 `json:"warn,omitempty"`
+	Crit  *float64 `json:"crit,omitempty"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+}
+
+// String 返回单项性能数据，省略末尾未设置的字段
+func (p PerfData) String() string {
+	var b strings.Builder
+	b.WriteString(perfLabel(p.Label))
+	b.WriteString("=")
+	b.WriteString(perfValue(&p.Value))
+	b.WriteString(p.Unit)
+	fields := []string{perfValue(p.Warn), perfValue(p.Crit), perfValue(p.Min), perfValue(p.Max)}
+	n := len(fields)
+	for n > 0 && fields[n-1] == "" {
+		n--
+	}
+	for _, f := range fields[:n] {
+		b.WriteString(";")
+		b.WriteString(f)
+	}
+	return b.String()
+}
+
+// perfLabel 标签包含空格、等号或单引号时用单引号括起，单引号转义为两个单引号
+func perfLabel(label string) string {
+	if !strings.ContainsAny(label, " ='") {
+		return label
+	}
+	return "'" + strings.ReplaceAll(label, "'", "''") + "'"
+}
+
+func perfValue(v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*v, 'f', -1, 64)
+}
+
+// FormatPerfData 返回以空格分隔的性能数据
+func FormatPerfData(perf []PerfData) string {
+	items := make([]string, len(perf))
+	for i, p := range perf {
+		items[i] = p.String()
+	}
+	return strings.Join(items, " ")
+}
+
+// OutputCheckerValuesWithPerfData 执行检查并输出 "消息 | 性能数据"，
+// 进程退出码由检查状态决定，perf为空时与 OutputCheckerValues 相同。
+// Format 为 FormatJSON 时以JSON格式输出，性能数据在 perfdata 字段中
+func (h *IdpcPlugin) OutputCheckerValuesWithPerfData(perf []PerfData) {
+	if mp, ok := h.checkerPlugin(); ok {
+		if h.Format == FormatJSON {
+			os.Exit(h.writeCheckerJSON(h.out(), mp, perf))
+		}
+		os.Exit(h.writeCheckerPerfData(h.out(), mp, perf))
+	}
+}
+
+func (h *IdpcPlugin) writeCheckerPerfData(w io.Writer, mp CheckerPlugin, perf []PerfData) int {
+	message, status := h.check(mp)
+	if len(perf) > 0 {
+		message += " | " + FormatPerfData(perf)
+	}
+	if _, err := io.WriteString(w, message+"\n"); err != nil {
+		h.logger().Error().Err(err).Msg("OutputCheckerValuesWithPerfData: ")
+	}
+	return status.ExitCode()
+}
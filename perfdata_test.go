@@ -0,0 +1,64 @@
+package plugin
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPerfDataString(t *testing.T) {
+	for _, tc := range []struct {
+		perf PerfData
+		want string
+	}{
+		{PerfData{Label: "rta", Value: 0.5, Unit: "ms", Warn: Bound(100), Crit: Bound(500), Min: Bound(0)}, "rta=0.5ms;100;500;0"},
+		{PerfData{Label: "pl", Value: 0, Unit: "%", Warn: Bound(20), Crit: Bound(60), Min: Bound(0), Max: Bound(100)}, "pl=0%;20;60;0;100"},
+		{PerfData{Label: "time", Value: 0.002722, Unit: "s", Min: Bound(0)}, "time=0.002722s;;;0"},
+		{PerfData{Label: "users", Value: 3, Crit: Bound(10)}, "users=3;;10"},
+		{PerfData{Label: "procs", Value: 42}, "procs=42"},
+		{PerfData{Label: "/ used", Value: 1024, Unit: "MB", Warn: Bound(2048), Crit: Bound(3072), Min: Bound(0), Max: Bound(4096)}, "'/ used'=1024MB;2048;3072;0;4096"},
+		{PerfData{Label: "it's", Value: -1.5}, "'it''s'=-1.5"},
+	} {
+		if got := tc.perf.String(); got != tc.want {
+			t.Errorf("got %q, want %q", got, tc.want)
+		}
+	}
+}
+
+func TestWriteCheckerPerfData(t *testing.T) {
+	p := testCombinedPlugin{testMetricsPlugin{key: "test"}}
+	h := NewIdpcPlugin(p)
+	perf := []PerfData{
+		{Label: "load1", Value: 0.15, Warn: Bound(5), Crit: Bound(10), Min: Bound(0)},
+		{Label: "load5", Value: 0.2, Warn: Bound(4), Crit: Bound(6), Min: Bound(0)},
+	}
+	buf := &bytes.Buffer{}
+	if code := h.writeCheckerPerfData(buf, p, perf); code != 0 {
+		t.Errorf("exit code = %d, want 0", code)
+	}
+	if want := "ok | load1=0.15;5;10;0 load5=0.2;4;6;0\n"; buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	h.writeCheckerPerfData(buf, p, nil)
+	if buf.String() != "ok\n" {
+		t.Errorf("without perfdata: got %q", buf.String())
+	}
+}
+
+func TestWriteCheckerJSONPerfData(t *testing.T) {
+	p := testCombinedPlugin{testMetricsPlugin{key: "test"}}
+	h := NewIdpcPlugin(p)
+	perf := []PerfData{
+		{Label: "load1", Value: 0.15, Warn: Bound(5), Crit: Bound(10)},
+		{Label: "used", Value: 42, Unit: "%"},
+	}
+	buf := &bytes.Buffer{}
+	if code := h.writeCheckerJSON(buf, p, perf); code != 0 {
+		t.Errorf("exit code = %d, want 0", code)
+	}
+	want := `{"status":"OK","message":"ok","perfdata":[{"label":"load1","value":0.15,"warn":5,"crit":10},{"label":"used","value":42,"unit":"%"}]}` + "\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
@@ -1,6 +1,9 @@
 package plugin
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/json"
 	"errors"
@@ -13,6 +16,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -30,16 +34,33 @@ const (
 
 // PluginVersionRegex ex.) idpc-plugin-redis-metrics version 0.0.1 (rev dev) [windows amd64 go1.16.5]
 
-var PluginVersionRegex = regexp.MustCompile(`^\s*idpc-plugin-(\w+)-(checker|metrics|metadata)\s+version\s+(\d{1,3}\.\d{1,3}\.\d{1,3})\s+\(rev\s+(\w+)\)\s+\[(\w+)\s+(\w+)\s+(.+)]`)
+var PluginVersionRegex = regexp.MustCompile(`^\s*idpc-plugin-(\w+)-(checker|metrics|metadata)\s+version\s+(\d{1,3}\.\d{1,3}\.\d{1,3}(?:-[0-9A-Za-z.-]+)?)\s+\(rev\s+(\w+)\)\s+\[(\w+)\s+(\w+)\s+(.+)]`)
 
+// ParseVersionCommand 解析插件 version 命令的输出，返回第一个符合 PluginVersionRegex 的行的信息，
+// 其他行被忽略，解析失败时返回空的Meta，见 ParseVersionCommandErr
 func ParseVersionCommand(s string) Meta {
-	details := PluginVersionRegex.FindStringSubmatch(s)
+	meta, _ := ParseVersionCommandErr(s)
+	return meta
+}
+
+// ErrVersionNoMatch 版本信息输出中没有符合 PluginVersionRegex 的行
+var ErrVersionNoMatch = errors.New("no line matches the version format")
+
+// ParseVersionCommandErr 与 ParseVersionCommand 相同，解析失败时返回错误，
+// 没有符合的行时错误满足 errors.Is(err, ErrVersionNoMatch)，错误信息中包含截断后的输入
+func ParseVersionCommandErr(s string) (Meta, error) {
+	var details []string
+	for _, line := range strings.Split(s, "\n") {
+		if details = PluginVersionRegex.FindStringSubmatch(line); details != nil {
+			break
+		}
+	}
 	if len(details) != 8 {
-		return Meta{}
+		return Meta{}, fmt.Errorf("%w: %q", ErrVersionNoMatch, truncate(s, versionSnapshotLen))
 	}
 	version, err := ParseVersion(details[3])
 	if err != nil {
-		return Meta{}
+		return Meta{}, fmt.Errorf("parse version %q in %q: %w", details[3], truncate(details[0], versionSnapshotLen), err)
 	}
 	return Meta{
 		Key:       details[1],
@@ -49,18 +70,59 @@ func ParseVersionCommand(s string) Meta {
 		GOOS:      details[5],
 		GOARCH:    details[6],
 		GOVersion: details[7],
+	}, nil
+}
+
+// versionSnapshotLen ParseVersionCommandErr 错误信息中保留的输入长度
+const versionSnapshotLen = 80
+
+// truncate 将s截断为最多n个字节，截断时追加 "..."
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
 	}
+	return s[:n] + "..."
 }
 
 // Metrics represents definition of a metric
 type Metrics struct {
-	Name         string  `json:"name"`
-	Label        string  `json:"label"`
-	Diff         bool    `json:"-"`
-	Type         string  `json:"-"`
-	Stacked      bool    `json:"stacked"`
-	Scale        float64 `json:"-"`
-	AbsoluteName bool    `json:"-"`
+	Name    string  `json:"name"`
+	Label   string  `json:"label"`
+	Diff    bool    `json:"-"`
+	Type    string  `json:"-"`
+	Stacked bool    `json:"stacked"`
+	Scale   float64 `json:"-"`
+	// AbsoluteName 为true时从 "图表key.Name" 读取指标值，输出名称为 "插件key.Name"，不包含图表key
+	AbsoluteName bool `json:"-"`
+	// Min/Max 指标值的合理范围，为nil时不限制，可以使用 Bound 设置
+	Min *float64 `json:"-"`
+	Max *float64 `json:"-"`
+	// Clamp 为true时超出范围的值被截断到边界值，否则丢弃该值
+	Clamp bool `json:"-"`
+	// Round 为true时将float值四舍五入为整数输出
+	Round bool `json:"-"`
+	// TimestampOffset 输出时从采集时间中减去的时间，用于后端报告的数据本身有延迟的情况
+	TimestampOffset time.Duration `json:"-"`
+	// RatePerSecond 为true时Diff指标输出每秒的速率，默认为每分钟
+	RatePerSecond bool `json:"-"`
+	// EmitBoth 为true时同时输出原始值 <name> 和差值 <name>.rate
+	EmitBoth bool `json:"-"`
+	// RatioIsFraction 为true且图表单位为 UnitPercentage 时，将0~1的比例值乘以100输出
+	RatioIsFraction bool `json:"-"`
+	// IntermittentDiff 为true时Diff指标在上次采集中不存在视为首次采集，不记录日志也不计入 Dropped，
+	// 用于只在某些功能启用时才出现的指标
+	IntermittentDiff bool `json:"-"`
+	// AllowDecrease 为true时该指标使用 ResetAllowDecrease，不论 IdpcPlugin.ResetPolicy 的设置
+	//
+	// Deprecated: 使用 IdpcPlugin.ResetPolicy 的 ResetAllowDecrease
+	AllowDecrease bool `json:"-"`
+	// DurationUnit time.Duration 类型的值的输出单位，例如 time.Millisecond，为0时以秒输出
+	DurationUnit time.Duration `json:"-"`
+}
+
+// Bound 返回v的指针，用于设置 Metrics.Min 和 Metrics.Max
+func Bound(v float64) *float64 {
+	return &v
 }
 
 // Graphs represents definition of a graph
@@ -77,18 +139,58 @@ type PluginValues struct {
 
 type Version struct {
 	Major, Minor, Patch uint32
+	// PreRelease 预发布版本标识，例如 1.4.0-rc2 中的 rc2，正式版本为空
+	PreRelease string
 }
 
 func (v Version) String() string {
+	if v.PreRelease != "" {
+		return fmt.Sprintf("%d.%d.%d-%s", v.Major, v.Minor, v.Patch, v.PreRelease)
+	}
 	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
 }
 
+// MarshalJSON 将版本编码为 "1.2.3" 格式的JSON字符串
+func (v Version) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.String())
+}
+
+// UnmarshalJSON 使用 ParseVersion 解析JSON字符串
+func (v *Version) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	ver, err := ParseVersion(s)
+	if err != nil {
+		return err
+	}
+	*v = ver
+	return nil
+}
+
+// MustParseVersion 与 ParseVersion 相同，解析失败时panic，用于初始化包级变量
+func MustParseVersion(s string) Version {
+	v, err := ParseVersion(s)
+	if err != nil {
+		panic(`plugin: ParseVersion(` + strconv.Quote(s) + `): ` + err.Error())
+	}
+	return v
+}
+
 func ParseVersion(s string) (Version, error) {
+	var preRelease string
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		s, preRelease = s[:i], s[i+1:]
+		if preRelease == "" {
+			return Version{}, fmt.Errorf("empty pre-release in %q", s+"-")
+		}
+	}
 	versionSplit := strings.SplitN(s, ".", 3)
 	if len(versionSplit) < 3 {
 		return Version{}, fmt.Errorf("expected Major.Minor.Patch in %q", s)
 	}
-	ver := Version{}
+	ver := Version{PreRelease: preRelease}
 	for i, v := range []*uint32{&ver.Major, &ver.Minor, &ver.Patch} {
 		var n64 uint64
 		var err error
@@ -122,9 +224,86 @@ func (v Version) LessThan(other Version) bool {
 	case v.Patch > other.Patch:
 		return false
 	default:
-		// this should only be reachable when versions are equal
-		return false
+		// 预发布版本低于对应的正式版本
+		return comparePreRelease(v.PreRelease, other.PreRelease) < 0
+	}
+}
+
+// comparePreRelease 按照语义化版本的规则比较预发布标识，空字符串(正式版本)最大。
+// 以 "." 分隔的各部分依次比较，数字部分按数值比较且小于非数字部分，前缀相同时部分较少的较小
+func comparePreRelease(a, b string) int {
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return 1
+	case b == "":
+		return -1
+	}
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.ParseUint(as[i], 10, 64)
+		bn, bErr := strconv.ParseUint(bs[i], 10, 64)
+		switch {
+		case aErr == nil && bErr == nil:
+			if an != bn {
+				if an < bn {
+					return -1
+				}
+				return 1
+			}
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		case as[i] != bs[i]:
+			if as[i] < bs[i] {
+				return -1
+			}
+			return 1
+		}
 	}
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	}
+	return 0
+}
+
+// Compare 比较两个版本，v比other旧时返回-1，相同时返回0，更新时返回1
+func (v Version) Compare(other Version) int {
+	switch {
+	case v.LessThan(other):
+		return -1
+	case other.LessThan(v):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Equal 判断两个版本是否相同
+func (v Version) Equal(other Version) bool {
+	return v.Compare(other) == 0
+}
+
+// GreaterThan 判断版本是否比other新
+func (v Version) GreaterThan(other Version) bool {
+	return v.Compare(other) > 0
+}
+
+// ByVersion 按版本从旧到新排序，实现 sort.Interface
+type ByVersion []Version
+
+func (s ByVersion) Len() int           { return len(s) }
+func (s ByVersion) Less(i, j int) bool { return s[i].LessThan(s[j]) }
+func (s ByVersion) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// SortVersions 将版本按从旧到新排序
+func SortVersions(versions []Version) {
+	sort.Sort(ByVersion(versions))
 }
 
 type Type string
@@ -151,6 +330,22 @@ func (b Meta) String() string {
 	return fmt.Sprintf("%s-%s-%s version %s (rev %s) [%s %s %s]",
 		PLUGIN_PREFIX, b.Key, b.Type, b.Version, b.Revision, b.GOOS, b.GOARCH, b.GOVersion)
 }
+
+// Redacted 返回将 Revision 和 GOVersion 替换为 "redacted" 的副本，
+// 其 String() 仍然可以被 ParseVersionCommand 解析
+func (b Meta) Redacted() Meta {
+	b.Revision = redactedField
+	b.GOVersion = redactedField
+	return b
+}
+
+const redactedField = "redacted"
+
+// Platform 返回 "GOOS/GOARCH" 格式的平台名称，例如 linux/amd64
+func (b Meta) Platform() string {
+	return b.GOOS + "/" + b.GOARCH
+}
+
 func (b Meta) Name() string {
 	return PLUGIN_PREFIX + "-" + b.Key + "-" + string(b.Type)
 }
@@ -167,7 +362,7 @@ type MetricsPlugin interface {
 
 type CheckerPlugin interface {
 	Plugin
-	Checker() (message, status string)
+	Checker() (message string, status Status)
 }
 
 type MetadataPlugin interface {
@@ -175,10 +370,118 @@ type MetadataPlugin interface {
 	Metadata() (map[string]interface{}, error)
 }
 
+// CollectHooks 可选接口，指标插件实现后在每次采集前后被调用，用于建立和释放共享资源
+type CollectHooks interface {
+	// PreCollect 在采集前调用，返回错误时不进行采集
+	PreCollect() error
+	// PostCollect 在 PreCollect 成功后、采集和输出结束时调用，err 为本次采集的错误
+	PostCollect(err error)
+}
+
 type IdpcPlugin struct {
 	Plugin
 	PluginRunner
 	TempFile string
+	// ErrorExitCodes 采集错误与进程退出码的对应关系，未匹配的错误退出码为1。
+	// 多项都匹配时，错误链中最外层的匹配优先，同一层匹配多项时使用靠前的一项
+	ErrorExitCodes []ErrorExitCode
+	// StrictGraphDef 为true时 OutputMeta 先使用 ValidateGraphDef 校验图表定义，校验失败时记录错误并退出
+	StrictGraphDef bool
+	// GraphOverrides 外部加载的图表定义(见 LoadGraphDefinition)，与插件内置定义合并
+	GraphOverrides map[string]Graphs
+	// SelectGraphs 不为空时只输出这些key的图表定义和指标，用于只运行大型插件的一部分
+	SelectGraphs []string
+	// MetadataThrottle 状态文件刚被更新时元数据插件是否仍然输出，默认跳过
+	MetadataThrottle MetadataThrottle
+	// MetadataForceEmit 为true时即使元数据与上次保存的相同也输出，默认只在元数据变化时输出
+	MetadataForceEmit bool
+	// Mode 本次运行的插件类型，用于同时实现多种插件接口的插件，为空时使用 PLUGIN_MODE_ENV_VAR 或 Meta().Type
+	Mode Type
+	// Format 输出格式，为空时使用默认格式，FormatJSON 输出JSON(用于检查插件和指标插件)，
+	// FormatPrometheus 输出Prometheus文本格式，FormatInflux 输出InfluxDB line protocol(用于指标插件)
+	Format string
+	// Out 插件输出(meta信息、指标值、检查结果等)的写入目标，为nil时使用 os.Stdout
+	Out io.Writer
+	// PrometheusTimestamps 为true时Prometheus格式输出的每个样本附带时间戳，见 OutputPrometheus
+	PrometheusTimestamps bool
+	// Timeout 单次指标采集的超时时间，为0时不限制
+	Timeout time.Duration
+	// UnitSuffix 为true时在输出的指标名称后追加图表单位，例如 bytes_read_bytes，
+	// 在 NameTransform 之前追加，保存的状态中的名称不受影响
+	UnitSuffix bool
+	// NameTransform 输出前对完整的指标名称进行转换，例如使用 NormalizeName 统一命名风格
+	NameTransform func(name string) string
+	// RedactVersion 为true时版本信息和 build_info 指标中不包含 Revision 和 GOVersion
+	RedactVersion bool
+	// ConstMetrics 每次运行都输出的常量指标，不依赖采集的值
+	ConstMetrics []ConstMetric
+	// BuildInfo 为true时额外输出 key.plugin.build_info 指标，携带插件的版本和构建信息
+	BuildInfo bool
+	// SensitiveMetrics 敏感指标的名称(Metrics返回的key)，日志中不输出这些指标的值
+	SensitiveMetrics []string
+	// Sink 不为nil时保存每次采集计算出的指标，见 LatestMetrics。
+	// 只保存状态已保存并且已成功输出的运行，被取消、失败和 Warmup 的运行不写入
+	Sink *MetricBuffer
+	// Logger 插件使用的日志记录器，为nil时使用zerolog的全局日志记录器
+	Logger *zerolog.Logger
+	// StateCodec 状态文件的编码格式，默认为 DefaultStateCodec
+	StateCodec StateCodec
+	// Store 状态的存储方式，为nil时保存在 TempFile 文件中，设置后 StateCodec 不再使用
+	Store StateStore
+	// MaxDiffDuration 计算Diff指标差值允许的最长采集间隔，超过时丢弃本次的值，
+	// 为0时使用默认的600秒，为负数时不限制
+	MaxDiffDuration time.Duration
+	// ResetPolicy Diff指标的值减少(计数器重置)时的处理方式，默认为 ResetWrapPlausible
+	ResetPolicy ResetPolicy
+	// StateIOTimeout 单次读写状态文件的超时时间，用于状态文件位于网络文件系统等可能阻塞的情况，为0时不限制
+	StateIOTimeout time.Duration
+	// StateLock 状态文件的加锁方式，默认不加锁
+	StateLock LockMode
+	// MinInterval 两次采集的最小间隔，距上次保存状态不足 MinInterval 时跳过本次运行，
+	// NewIdpcPlugin 设置为1秒，为0时不检查
+	MinInterval time.Duration
+	// LockTimeout LockBlock 模式下等待锁的最长时间，超时后跳过本次运行，为0时一直等待
+	LockTimeout time.Duration
+	// Clock 返回当前时间，用于指标和元数据的时间戳，为nil时使用 time.Now
+	Clock func() time.Time
+	// EmitDropped 为true时额外输出 key.plugin.dropped 指标，按原因统计本次运行丢弃的指标数量
+	EmitDropped bool
+	// EmitResets 为true时为检测到过计数器重置的指标输出 key.plugin.seconds_since_reset 指标
+	EmitResets bool
+	// WindowSize 不为0时在状态中保存每个指标最近 WindowSize 次的原始值，供 CheckPercentile 使用，
+	// 窗口只能保存在 DefaultStateCodec 格式的状态文件中
+	WindowSize int
+	// BackfillGauges 为true时进程内首次采集前先输出上次保存的非Diff指标值(使用保存时的时间)，
+	// 用于长期运行的进程(如 ServeHTTP)重启后填补图表的空白。一次性运行(Run)时不回填，
+	// 上次保存的状态早于 BackfillMaxAge 时也不回填
+	BackfillGauges bool
+	// BackfillMaxAge BackfillGauges 回填的值的最长时间，为0时使用 MaxDiffDuration 的两倍，为负数时不限制
+	BackfillMaxAge time.Duration
+	// PprofAddr 不为空时 ServeHTTP 运行期间在该地址提供 net/http/pprof，用于分析采集的性能，
+	// 一次性运行(Run)时不启动。需要使用 -tags pprof 构建，否则 ServeHTTP 返回错误
+	PprofAddr string
+	// DecimalSeparator 制表符分隔格式中浮点数的小数点，为空时使用 "."，
+	// 只用于要求其他小数点(例如 ",")的下游程序
+	DecimalSeparator string
+	// SignKey 不为nil时在指标输出后追加 "# signature hmac-sha256 <hex>" 签名行，
+	// 签名只覆盖本次运行的输出。为nil时使用 PLUGIN_SIGN_KEY_ENV_VAR 或 PLUGIN_SIGN_KEY_FILE_ENV_VAR 中的密钥，见 VerifySignedOutput
+	SignKey []byte
+	// Summary 为true时在输出指标后向标准错误输出 "# emitted N metrics in Dms" 摘要行
+	Summary bool
+	// GraphComments 为true时在每个图表的指标前输出 "# graph: label (unit)" 注释行，便于调试
+	GraphComments bool
+
+	stateLock *os.File
+	dropped   map[DropReason]int
+	resets    map[string]time.Time
+	// backfilled 是否已经执行过 BackfillGauges
+	backfilled bool
+	// wildcardRegexps 已编译的通配符指标正则表达式，key为通配符模式
+	wildcardRegexps map[string]*regexp.Regexp
+	// wildcardIndex 本次采集中每个通配符模式匹配的key，见 indexWildcards
+	wildcardIndex map[string][]string
+	// ctx 本次运行的context，见 RunContext
+	ctx context.Context
 }
 
 type PluginRunner interface {
@@ -191,48 +494,72 @@ type PluginRunner interface {
 }
 
 func NewIdpcPlugin(plugin Plugin) IdpcPlugin {
-	mp := IdpcPlugin{Plugin: plugin}
+	mp := IdpcPlugin{Plugin: plugin, MinInterval: time.Second}
 	return mp
 }
 
+// MetricLine 一个计算完成、待输出的指标值
+type MetricLine struct {
+	Name  string
+	Value interface{}
+	Time  time.Time
+	// counter 和 help 用于Prometheus格式输出，counter 表示 Metrics.EmitBoth 输出的原始累计值，help 来自 Metrics.Label
+	counter bool
+	help    string
+	// labels 构建信息和常量指标的标签，见 Label
+	labels []Label
+}
+
+func (h *IdpcPlugin) printLine(w io.Writer, line MetricLine) {
+	h.printValue(w, line.Name, line.Value, line.Time)
+}
+
 func (h *IdpcPlugin) printValue(w io.Writer, key string, value interface{}, now time.Time) {
-	switch v := value.(type) {
+	if !h.validValue(key, value) {
+		return
+	}
+	switch v := normalizeValue(value).(type) {
 	case uint32:
 		fmt.Fprintf(w, "%s\t%d\t%d\n", key, v, now.Unix())
 	case uint64:
 		fmt.Fprintf(w, "%s\t%d\t%d\n", key, v, now.Unix())
+	case int64:
+		fmt.Fprintf(w, "%s\t%d\t%d\n", key, v, now.Unix())
 	case float64:
-		if math.IsNaN(value.(float64)) || math.IsInf(v, 0) {
-			log.Printf("Invalid value: key = %s, value = %f\n", key, value)
-		} else {
-			fmt.Fprintf(w, "%s\t%f\t%d\n", key, v, now.Unix())
-		}
+		fmt.Fprintf(w, "%s\t%s\t%d\n", key, h.formatFloat(v), now.Unix())
+	default:
+		h.logger().Warn().Msgf("Unsupported value type, dropped: key = %s, type = %T", key, value)
 	}
 }
 
-// LoadLastValues 从缓存文件中加载插件数据，插件数据为Metadata数据或者Metrics数据
-func (h *IdpcPlugin) LoadLastValues() (values PluginValues, err error) {
-	f, err := os.Open(h.tempFilename())
-	if err != nil {
-		if os.IsNotExist(err) {
-			return values, nil
-		}
-		return
+// formatFloat 以6位小数格式化浮点数，设置了 DecimalSeparator 时替换小数点
+func (h *IdpcPlugin) formatFloat(v float64) string {
+	s := strconv.FormatFloat(v, 'f', 6, 64)
+	if h.DecimalSeparator != "" {
+		s = strings.Replace(s, ".", h.DecimalSeparator, 1)
 	}
-	defer f.Close()
+	return s
+}
 
-	decoder := json.NewDecoder(f)
-	err = decoder.Decode(&values.Values)
-	if err != nil {
-		return
+// validValue 判断value是否可以输出，NaN和Inf不能输出
+func (h *IdpcPlugin) validValue(key string, value interface{}) bool {
+	if v, ok := value.(float64); ok && (math.IsNaN(v) || math.IsInf(v, 0)) {
+		h.logger().Printf("Invalid value: key = %s, value = %f\n", key, v)
+		return false
 	}
-	switch v := values.Values["_lastTime"].(type) {
-	case float64:
-		values.Timestamp = time.Unix(int64(v), 0)
-	case int64:
-		values.Timestamp = time.Unix(v, 0)
+	return true
+}
+
+// LoadLastValues 从 Store (默认为缓存文件)中加载插件数据，插件数据为Metadata数据或者Metrics数据，
+// 文件不存在或无法解码时返回空数据
+func (h *IdpcPlugin) LoadLastValues() (values PluginValues, err error) {
+	unlock, err := h.lockState()
+	if err != nil {
+		return values, err
 	}
-	return
+	defer unlock()
+
+	return h.stateIO(h.store().Load)
 }
 
 var errStateUpdated = errors.New("state was recently updated")
@@ -242,33 +569,122 @@ func (h *IdpcPlugin) loadLastValuesSafe(now time.Time) (m PluginValues, err erro
 	if err != nil {
 		return m, err
 	}
-	if now.Sub(m.Timestamp) < time.Second {
+	if h.MinInterval > 0 && now.Sub(m.Timestamp) < h.MinInterval {
 		return m, errStateUpdated
 	}
 	return m, nil
 }
 
-// SaveValues 保存插件数据
+// SaveValues 将插件数据保存到 Store (默认为缓存文件)，
+// 缓存文件先写入同一目录下的临时文件再重命名，写入失败或进程中途退出时原文件保持不变
 func (h *IdpcPlugin) SaveValues(values PluginValues) error {
-	f, err := os.Create(h.tempFilename())
+	unlock, err := h.lockState()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	defer unlock()
 
 	values.Values["_lastTime"] = values.Timestamp.Unix()
-	encoder := json.NewEncoder(f)
-	err = encoder.Encode(values.Values)
-	if err != nil {
-		return err
+	store := h.store()
+	_, err = h.stateIO(func() (PluginValues, error) {
+		return PluginValues{}, store.Save(values)
+	})
+	return err
+}
+
+var errStateIOTimeout = errors.New("state file I/O timed out")
+
+// stateIO 执行状态文件的读写，设置了 StateIOTimeout 时超时返回 errStateIOTimeout，
+// 超时后fn仍在后台继续执行直到完成
+func (h *IdpcPlugin) stateIO(fn func() (PluginValues, error)) (PluginValues, error) {
+	if h.StateIOTimeout <= 0 {
+		return fn()
+	}
+	type result struct {
+		values PluginValues
+		err    error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		values, err := fn()
+		ch <- result{values, err}
+	}()
+	timer := time.NewTimer(h.StateIOTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		return r.values, r.err
+	case <-timer.C:
+		return PluginValues{}, errStateIOTimeout
 	}
-	return nil
 }
 
-func (h *IdpcPlugin) calcDiff(value float64, now time.Time, lastValue float64, lastTime time.Time) (float64, error) {
+// ResetPolicy Diff指标的值比上次减少时的处理方式
+type ResetPolicy int
+
+const (
+	// ResetWrapPlausible 默认的处理方式，uint32和uint64类型的指标在可能是一次溢出回绕时
+	// 按回绕计算差值(见 wrapPlausible)，其余情况同 ResetStrict
+	ResetWrapPlausible ResetPolicy = iota
+	// ResetStrict 任何减少都视为计数器重置并丢弃本次的值
+	ResetStrict
+	// ResetWrap uint32和uint64类型的指标总是按溢出回绕计算差值，其他类型同 ResetStrict
+	ResetWrap
+	// ResetZero 视为计数器重置并输出0作为本次的差值
+	ResetZero
+	// ResetAllowDecrease 减少不视为计数器重置，输出负的差值
+	ResetAllowDecrease
+)
+
+// resetPolicy 返回指标使用的 ResetPolicy，设置了 Metrics.AllowDecrease 时为 ResetAllowDecrease
+func (h *IdpcPlugin) resetPolicy(metric Metrics) ResetPolicy {
+	if metric.AllowDecrease {
+		return ResetAllowDecrease
+	}
+	return h.ResetPolicy
+}
+
+var (
+	errTooLongDuration = errors.New("too long duration")
+	errCounterReset    = errors.New("counter seems to be reset")
+	errOutOfOrder      = errors.New("timestamp is not after the last fetch")
+	errSameTimestamp   = errors.New("no time elapsed since the last fetch")
+)
+
+// diffSeconds 返回距上次采集的秒数，间隔过长、为0(同一秒内采集)或为负数(时间戳乱序)时返回错误
+func (h *IdpcPlugin) diffSeconds(now, lastTime time.Time) (int64, error) {
 	diffTime := now.Unix() - lastTime.Unix()
-	if diffTime > 600 {
-		return 0, errors.New("too long duration")
+	if diffTime == 0 {
+		return 0, errSameTimestamp
+	}
+	if diffTime < 0 {
+		return 0, errOutOfOrder
+	}
+	if limit := h.maxDiffDuration(); limit > 0 && diffTime > int64(limit/time.Second) {
+		return 0, errTooLongDuration
+	}
+	return diffTime, nil
+}
+
+// defaultMaxDiffDuration MaxDiffDuration 的默认值
+const defaultMaxDiffDuration = 600 * time.Second
+
+// maxDiffDuration 返回计算差值允许的最长采集间隔，不限制时返回0
+func (h *IdpcPlugin) maxDiffDuration() time.Duration {
+	switch {
+	case h.MaxDiffDuration == 0:
+		return defaultMaxDiffDuration
+	case h.MaxDiffDuration < 0:
+		return 0
+	default:
+		return h.MaxDiffDuration
+	}
+}
+
+func (h *IdpcPlugin) calcDiff(value float64, now time.Time, lastValue float64, lastTime time.Time) (float64, error) {
+	diffTime, err := h.diffSeconds(now, lastTime)
+	if err != nil {
+		return 0, err
 	}
 
 	diff := (value - lastValue) * 60 / float64(diffTime)
@@ -276,36 +692,80 @@ func (h *IdpcPlugin) calcDiff(value float64, now time.Time, lastValue float64, l
 	if lastValue <= value {
 		return diff, nil
 	}
-	return 0.0, errors.New("counter seems to be reset")
+	return 0.0, errCounterReset
 }
 
-func (h *IdpcPlugin) calcDiffUint32(value uint32, now time.Time, lastValue uint32, lastTime time.Time, lastDiff float64) (float64, error) {
-	diffTime := now.Unix() - lastTime.Unix()
-	if diffTime > 600 {
-		return 0, errors.New("too long duration")
+// int64ResetDrop 有符号整数计数器减少超过上次值的该比例时视为计数器重置
+const int64ResetDrop = 0.5
+
+// calcDiffInt64 计算有符号整数计数器的每分钟差值，计数器可能正常地小幅减少，
+// 只有减少超过上次值的一半(int64ResetDrop)时才视为计数器重置
+func (h *IdpcPlugin) calcDiffInt64(value int64, now time.Time, lastValue int64, lastTime time.Time) (float64, error) {
+	diffTime, err := h.diffSeconds(now, lastTime)
+	if err != nil {
+		return 0, err
 	}
+	diff := float64(value-lastValue) * 60 / float64(diffTime)
+	if value >= lastValue || float64(lastValue-value) <= math.Abs(float64(lastValue))*int64ResetDrop {
+		return diff, nil
+	}
+	return 0.0, errCounterReset
+}
 
-	diff := float64((value-lastValue)*60) / float64(diffTime)
+// calcDiffGauge 计算允许为负数的差值，用于可能减少的指标(ResetAllowDecrease)
+func (h *IdpcPlugin) calcDiffGauge(value float64, now time.Time, lastValue float64, lastTime time.Time) (float64, error) {
+	diffTime, err := h.diffSeconds(now, lastTime)
+	if err != nil {
+		return 0, err
+	}
+	return (value - lastValue) * 60 / float64(diffTime), nil
+}
 
-	if lastValue <= value || diff < lastDiff*10 {
-		return diff, nil
+func (h *IdpcPlugin) calcDiffUint32(value uint32, now time.Time, lastValue uint32, lastTime time.Time, lastDiff float64, policy ResetPolicy) (float64, error) {
+	diffTime, err := h.diffSeconds(now, lastTime)
+	if err != nil {
+		return 0, err
 	}
-	return 0.0, errors.New("counter seems to be reset")
 
+	// 无符号整数的减法在溢出回绕时也得到正确的增量
+	delta := value - lastValue
+	diff := float64(delta) * 60 / float64(diffTime)
+
+	if lastValue <= value || policy == ResetWrap || policy == ResetWrapPlausible && wrapPlausible(diff, lastDiff, delta < math.MaxUint32/2) {
+		return diff, nil
+	}
+	return 0.0, errCounterReset
 }
 
-func (h *IdpcPlugin) calcDiffUint64(value uint64, now time.Time, lastValue uint64, lastTime time.Time, lastDiff float64) (float64, error) {
-	diffTime := now.Unix() - lastTime.Unix()
-	if diffTime > 600 {
-		return 0, errors.New("too long duration")
+func (h *IdpcPlugin) calcDiffUint64(value uint64, now time.Time, lastValue uint64, lastTime time.Time, lastDiff float64, policy ResetPolicy) (float64, error) {
+	diffTime, err := h.diffSeconds(now, lastTime)
+	if err != nil {
+		return 0, err
 	}
 
-	diff := float64((value-lastValue)*60) / float64(diffTime)
+	// 无符号整数的减法在溢出回绕时也得到正确的增量
+	delta := value - lastValue
+	diff := float64(delta) * 60 / float64(diffTime)
 
-	if lastValue <= value || diff < lastDiff*10 {
+	if lastValue <= value || policy == ResetWrap || policy == ResetWrapPlausible && wrapPlausible(diff, lastDiff, delta < math.MaxUint64/2) {
 		return diff, nil
 	}
-	return 0.0, errors.New("counter seems to be reset")
+	return 0.0, errCounterReset
+}
+
+// wrapPlausible 判断计数器的减少是否可以视为一次溢出回绕：有上次的差值时回绕后的差值应小于其10倍，
+// 否则回绕后的增量应小于计数器范围的一半(withinHalf)，其余情况视为计数器重置
+func wrapPlausible(diff, lastDiff float64, withinHalf bool) bool {
+	if lastDiff > 0 {
+		return diff < lastDiff*10
+	}
+	return withinHalf
+}
+
+// StateFilePath 返回状态文件的路径，未设置 TempFile 时根据插件key、类型和命令行参数计算，
+// 可用于外部清理过期的状态文件
+func (h *IdpcPlugin) StateFilePath() string {
+	return h.tempFilename()
 }
 
 func (h *IdpcPlugin) tempFilename() string {
@@ -326,17 +786,54 @@ func (h *IdpcPlugin) tempFilename() string {
 const (
 	metricTypeUint32 = "uint32"
 	metricTypeUint64 = "uint64"
+	// metricTypeInt64 有符号整数计数器，Diff时小幅减少输出负的差值，见 calcDiffInt64
+	metricTypeInt64 = "int64"
 	// metricTypeFloat  = "float64"
 )
 
-func (h *IdpcPlugin) formatValues(prefix string, metric Metrics, metricValues PluginValues, lastMetricValues PluginValues) {
+// percentMetric 返回在graph中使用的指标定义，RatioIsFraction 只对百分比单位的图表生效
+func percentMetric(graph Graphs, metric Metrics) Metrics {
+	if graph.Unit != UnitPercentage {
+		metric.RatioIsFraction = false
+	}
+	return metric
+}
+
+// formatMetric 计算一个指标定义对应的所有输出值
+func (h *IdpcPlugin) formatMetric(prefix string, metric Metrics, metricValues PluginValues, lastMetricValues PluginValues) []MetricLine {
+	if metric.EmitBoth {
+		raw, rate := metric, metric
+		raw.EmitBoth, rate.EmitBoth = false, false
+		raw.Diff, rate.Diff = false, true
+		lines := h.formatMetric(prefix, raw, metricValues, lastMetricValues)
+		for i := range lines {
+			lines[i].counter = true
+		}
+		for _, line := range h.formatMetric(prefix, rate, metricValues, lastMetricValues) {
+			line.Name += ".rate"
+			lines = append(lines, line)
+		}
+		return lines
+	}
+	if isWildcard(prefix, metric) {
+		return h.formatValuesWithWildcard(prefix, metric, metricValues, lastMetricValues)
+	}
+	if line, ok := h.formatValues(prefix, metric, metricValues, lastMetricValues); ok {
+		return []MetricLine{line}
+	}
+	return nil
+}
+
+// formatValues 计算指标的输出值，指标不存在或值无效时返回false
+func (h *IdpcPlugin) formatValues(prefix string, metric Metrics, metricValues PluginValues, lastMetricValues PluginValues) (MetricLine, bool) {
 	name := metric.Name
 	if metric.AbsoluteName && len(prefix) > 0 {
 		name = prefix + "." + name
 	}
 	value, ok := metricValues.Values[name]
 	if !ok || value == nil {
-		return
+		h.drop(DropMissing)
+		return MetricLine{}, false
 	}
 
 	var err error
@@ -346,14 +843,25 @@ func (h *IdpcPlugin) formatValues(prefix string, metric Metrics, metricValues Pl
 			value, err = strconv.ParseUint(v, 10, 32)
 		case metricTypeUint64:
 			value, err = strconv.ParseUint(v, 10, 64)
+		case metricTypeInt64:
+			value, err = strconv.ParseInt(v, 10, 64)
 		default:
 			value, err = strconv.ParseFloat(v, 64)
 		}
 	}
+	if d, ok := value.(time.Duration); ok {
+		value = durationValue(d, metric.DurationUnit)
+		// 保存转换后的值，下次计算差值时与上次的值单位一致
+		metricValues.Values[name] = value
+	}
+	value = normalizeValue(value)
 	if err != nil {
 		// For keeping compatibility, if each above statement occurred the error,
 		// then the value is set to 0 and continue.
-		log.Print("Parsing a value: ", err)
+		if ne, ok := err.(*strconv.NumError); ok && h.isSensitive(name) {
+			ne.Num = redacted
+		}
+		h.logger().Print("Parsing a value: ", err)
 	}
 
 	if metric.Diff {
@@ -364,71 +872,156 @@ func (h *IdpcPlugin) formatValues(prefix string, metric Metrics, metricValues Pl
 				lastDiff = toFloat64(lastMetricValues.Values[".last_diff."+name])
 			}
 			var err error
-			switch metric.Type {
-			case metricTypeUint32:
-				value, err = h.calcDiffUint32(toUint32(value), metricValues.Timestamp, toUint32(lastMetricValues.Values[name]), lastMetricValues.Timestamp, lastDiff)
-			case metricTypeUint64:
-				value, err = h.calcDiffUint64(toUint64(value), metricValues.Timestamp, toUint64(lastMetricValues.Values[name]), lastMetricValues.Timestamp, lastDiff)
+			policy := h.resetPolicy(metric)
+			switch {
+			case policy == ResetAllowDecrease:
+				value, err = h.calcDiffGauge(toFloat64(value), metricValues.Timestamp, toFloat64(lastMetricValues.Values[name]), lastMetricValues.Timestamp)
+			case metric.Type == metricTypeUint32:
+				value, err = h.calcDiffUint32(toUint32(value), metricValues.Timestamp, toUint32(lastMetricValues.Values[name]), lastMetricValues.Timestamp, lastDiff, policy)
+			case metric.Type == metricTypeUint64:
+				value, err = h.calcDiffUint64(toUint64(value), metricValues.Timestamp, toUint64(lastMetricValues.Values[name]), lastMetricValues.Timestamp, lastDiff, policy)
+			case metric.Type == metricTypeInt64:
+				value, err = h.calcDiffInt64(toInt64(value), metricValues.Timestamp, toInt64(lastMetricValues.Values[name]), lastMetricValues.Timestamp)
 			default:
 				value, err = h.calcDiff(toFloat64(value), metricValues.Timestamp, toFloat64(lastMetricValues.Values[name]), lastMetricValues.Timestamp)
 			}
+			if err == errCounterReset {
+				metricValues.Values[lastResetPrefix+name] = metricValues.Timestamp.Unix()
+				if policy == ResetZero {
+					value, err = 0.0, nil
+				}
+			}
 			if err != nil {
-				log.Error().Err(err).Msg("OutputValues: ")
-				return
+				h.drop(diffDropReason(err))
+				h.logger().Error().Err(err).Msg("OutputValues: ")
+				return MetricLine{}, false
 			}
 			metricValues.Values[".last_diff."+name] = value
+			if metric.RatePerSecond {
+				// 差值是每分钟的速率
+				value = value.(float64) / 60
+			}
+		} else if metric.IntermittentDiff {
+			// 间歇出现的指标重新出现时视为首次采集
+			return MetricLine{}, false
 		} else {
-			log.Debug().Msgf("%s does not exist at last fetch\n", name)
-			return
+			h.drop(DropNoLastValue)
+			h.logger().Debug().Msgf("%s does not exist at last fetch\n", name)
+			return MetricLine{}, false
 		}
 	}
 
 	if metric.Scale != 0 {
 		switch metric.Type {
 		case metricTypeUint32:
-			value = toUint32(value) * uint32(metric.Scale)
+			value = uint32(scaleUint64(uint64(toUint32(value)), metric.Scale))
 		case metricTypeUint64:
-			value = toUint64(value) * uint64(metric.Scale)
+			value = scaleUint64(toUint64(value), metric.Scale)
+		case metricTypeInt64:
+			value = scaleInt64(toInt64(value), metric.Scale)
 		default:
 			value = toFloat64(value) * metric.Scale
 		}
 	}
 
+	if metric.RatioIsFraction {
+		value = toFloat64(value) * 100
+	}
+
+	if !h.validValue(name, value) {
+		h.drop(DropInvalid)
+		return MetricLine{}, false
+	}
+	value, ok = h.checkBounds(name, metric, value)
+	if !ok {
+		h.drop(DropOutOfRange)
+		return MetricLine{}, false
+	}
+
+	if metric.Round {
+		if v, ok := value.(float64); ok {
+			value = int64(math.Round(v))
+		}
+	}
+
 	var metricNames []string
 	metricNames = append(metricNames, h.Plugin.Meta().Key)
-	if len(prefix) > 0 {
+	if len(prefix) > 0 && !metric.AbsoluteName {
 		metricNames = append(metricNames, prefix)
 	}
 	metricNames = append(metricNames, metric.Name)
-	h.printValue(os.Stdout, strings.Join(metricNames, "."), value, metricValues.Timestamp)
+	return MetricLine{
+		Name:  strings.Join(metricNames, "."),
+		Value: value,
+		Time:  metricValues.Timestamp.Add(-metric.TimestampOffset),
+		help:  metric.Label,
+	}, true
 }
 
-func (h *IdpcPlugin) formatValuesWithWildcard(prefix string, metric Metrics, metricValues PluginValues, lastMetricValues PluginValues) {
-	regexpStr := `\A` + prefix + "." + metric.Name
-	regexpStr = strings.Replace(regexpStr, ".", "\\.", -1)
-	regexpStr = strings.Replace(regexpStr, "*", "[-a-zA-Z0-9_]+", -1)
-	regexpStr = strings.Replace(regexpStr, "#", "[-a-zA-Z0-9_]+", -1)
-	re, err := regexp.Compile(regexpStr)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to compile regexp: ")
-	}
-	for k := range metricValues.Values {
-		if re.MatchString(k) {
-			metricEach := metric
-			metricEach.Name = k
-			h.formatValues("", metricEach, metricValues, lastMetricValues)
+func (h *IdpcPlugin) formatValuesWithWildcard(prefix string, metric Metrics, metricValues PluginValues, lastMetricValues PluginValues) []MetricLine {
+	var lines []MetricLine
+	for _, k := range h.wildcardKeys(wildcardPattern(prefix, metric), metricValues.Values) {
+		metricEach := metric
+		metricEach.Name = k
+		p := ""
+		if metric.AbsoluteName && prefix != "" {
+			// 与非通配符指标一致，输出名称不包含图表key
+			metricEach.Name = strings.TrimPrefix(k, prefix+".")
+			p = prefix
+		}
+		if line, ok := h.formatValues(p, metricEach, metricValues, lastMetricValues); ok {
+			lines = append(lines, line)
 		}
 	}
+	return lines
 }
 
 var PLUGIN_META_ENV_VAR = strings.ReplaceAll(strings.ToUpper(PLUGIN_PREFIX), "-", "_") + "_META"
 
+// PLUGIN_MODE_ENV_VAR 运行时选择插件类型(metrics、checker、metadata)的环境变量
+var PLUGIN_MODE_ENV_VAR = strings.ReplaceAll(strings.ToUpper(PLUGIN_PREFIX), "-", "_") + "_MODE"
+
+// mode 返回本次运行的插件类型，优先使用 Mode，其次是 PLUGIN_MODE_ENV_VAR 环境变量，最后是 Meta().Type
+func (h *IdpcPlugin) mode() Type {
+	if h.Mode != "" {
+		return h.Mode
+	}
+	if env := os.Getenv(PLUGIN_MODE_ENV_VAR); env != "" {
+		if t := Type(strings.ToLower(env)); validType(t) {
+			return t
+		}
+		h.logger().Warn().Msgf("Invalid %s: %s", PLUGIN_MODE_ENV_VAR, env)
+	}
+	return h.Plugin.Meta().Type
+}
+
+// validType 判断t是否为可以运行的插件类型
+func validType(t Type) bool {
+	switch t {
+	case TypeChecker, TypeMetrics, TypeMetadata:
+		return true
+	}
+	return false
+}
+
 // Run the plugin
 func (h *IdpcPlugin) Run() {
-	if os.Getenv(PLUGIN_PREFIX+"DEBUG") != "" {
-		log.Logger = log.Logger.Level(zerolog.DebugLevel)
-	} else {
-		log.Logger = log.Logger.Level(zerolog.ErrorLevel)
+	h.RunContext(context.Background())
+}
+
+// RunContext 与 Run 相同，ctx被取消时停止采集并且不保存状态
+func (h *IdpcPlugin) RunContext(ctx context.Context) {
+	h.ctx = ctx
+	defer func() { h.ctx = nil }()
+	// 每次运行都是新的进程，回填会重复输出上次的值
+	h.backfilled = true
+	// 注入的日志记录器由调用方控制级别
+	if h.Logger == nil {
+		if os.Getenv(PLUGIN_PREFIX+"DEBUG") != "" {
+			log.Logger = log.Logger.Level(zerolog.DebugLevel)
+		} else {
+			log.Logger = log.Logger.Level(zerolog.ErrorLevel)
+		}
 	}
 	if os.Getenv(PLUGIN_META_ENV_VAR) != "" {
 		h.OutputMeta()
@@ -437,18 +1030,44 @@ func (h *IdpcPlugin) Run() {
 	}
 }
 
+// displayMeta 返回对外展示的插件meta信息，设置了 RedactVersion 时隐藏构建信息
+func (h *IdpcPlugin) displayMeta() Meta {
+	meta := h.Plugin.Meta()
+	if h.RedactVersion {
+		return meta.Redacted()
+	}
+	return meta
+}
+
 func (h *IdpcPlugin) Version() string {
-	return h.Plugin.Meta().String()
+	return h.displayMeta().String()
 }
 
 // OutputValues output the metrics
 func (h *IdpcPlugin) OutputValues() {
-	meta := h.Plugin.Meta()
-	switch meta.Type {
+	switch h.mode() {
 	case TypeChecker:
-		h.OutputCheckerValues()
+		if h.Format == FormatJSON {
+			h.OutputCheckerJSON(h.out())
+		} else {
+			h.OutputCheckerValues()
+		}
 	case TypeMetrics:
-		h.OutputMetricsValues()
+		var err error
+		switch h.Format {
+		case FormatJSON:
+			err = h.OutputMetricsValuesJSON(h.out())
+		case FormatPrometheus:
+			err = h.OutputPrometheus(h.out())
+		case FormatInflux:
+			err = h.OutputMetricsValuesInflux(h.out(), h.Plugin.Meta().Key, nil)
+		default:
+			h.OutputMetricsValues()
+		}
+		if err != nil {
+			h.logger().Error().Err(err).Msg("OutputValues: ")
+			os.Exit(h.exitCode(err))
+		}
 	case TypeMetadata:
 		h.OutputMetadataValues()
 	}
@@ -462,122 +1081,656 @@ type GraphDef struct {
 
 // OutputMeta 打印输出插件meta信息
 func (h *IdpcPlugin) OutputMeta() {
-	builder := strings.Builder{}
-	builder.WriteString(h.Meta().String())
-	builder.WriteString("\n")
+	if mp, ok := h.Plugin.(MetricsPlugin); ok && h.StrictGraphDef {
+		if err := ValidateGraphDef(h.graphDefinition(mp)); err != nil {
+			h.logger().Error().Err(err).Msg("OutputMeta: invalid graph definition")
+			os.Exit(1)
+		}
+	}
+	w := bufio.NewWriter(h.out())
+	h.writeMeta(w)
+	w.Flush()
+}
+
+func (h *IdpcPlugin) writeMeta(w io.Writer) {
+	io.WriteString(w, h.displayMeta().String())
+	io.WriteString(w, "\n")
 	if mp, ok := h.Plugin.(MetricsPlugin); ok {
-		graphs := make(map[string]Graphs)
-		for key, graph := range mp.GraphDefinition() {
-			g := graph
-			k := key
-			prefix := h.Plugin.Meta().Key
-			if k == "" {
-				k = prefix
-			} else {
-				k = prefix + "." + k
-			}
-			if g.Label == "" {
-				g.Label = title(k)
-			}
-			var metrics []Metrics
-			for _, v := range g.Metrics {
-				if v.Label == "" {
-					v.Label = title(v.Name)
-				}
-				metrics = append(metrics, v)
+		err := h.writeGraphDef(w, h.graphDefinition(mp))
+		if err != nil {
+			h.logger().Debug().Err(err).Msg("OutputDefinitions: ")
+		}
+	}
+	io.WriteString(w, "\n")
+}
+
+// writeGraphDef 逐个编码图表定义并写入w，避免为大量图表构建完整的map，
+// 输出与 json.Marshal(GraphDef{...}) 完全一致
+func (h *IdpcPlugin) writeGraphDef(w io.Writer, defs map[string]Graphs) error {
+	type graphKey struct {
+		name string
+		key  string
+	}
+	keys := make([]graphKey, 0, len(defs))
+	for key := range defs {
+		keys = append(keys, graphKey{name: h.graphName(key), key: key})
+	}
+	// json.Marshal writes map keys in sorted order
+	sort.Slice(keys, func(i, j int) bool { return keys[i].name < keys[j].name })
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encode := func(v interface{}) ([]byte, error) {
+		buf.Reset()
+		if err := encoder.Encode(v); err != nil {
+			return nil, err
+		}
+		// Encode terminates each value with a newline
+		return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+	}
+
+	if _, err := io.WriteString(w, `{"graphs":{`); err != nil {
+		return err
+	}
+	for i, gk := range keys {
+		g := defs[gk.key]
+		if g.Label == "" {
+			g.Label = title(gk.name)
+		}
+		var metrics []Metrics
+		for _, v := range g.Metrics {
+			if v.Label == "" {
+				v.Label = title(v.Name)
 			}
-			g.Metrics = metrics
-			graphs[k] = g
+			metrics = append(metrics, v)
+		}
+		g.Metrics = metrics
+
+		if i > 0 {
+			io.WriteString(w, ",")
+		}
+		b, err := encode(gk.name)
+		if err != nil {
+			return err
 		}
-		var graphdef GraphDef
-		graphdef.Graphs = graphs
-		b, err := json.Marshal(graphdef)
+		w.Write(b)
+		io.WriteString(w, ":")
+		b, err = encode(g)
 		if err != nil {
-			log.Debug().Err(err).Msg("OutputDefinitions: ")
+			return err
+		}
+		if _, err = w.Write(b); err != nil {
+			return err
 		}
-		builder.Write(b)
 	}
-	fmt.Println(builder.String())
+	_, err := io.WriteString(w, "}}")
+	return err
 }
 
+// WriteMetricsValues 采集指标并将计算后的值写入w，与 OutputMetricsValues 相同，
+// 但出错时返回错误而不退出进程，用于在其它程序中嵌入插件
+func (h *IdpcPlugin) WriteMetricsValues(w io.Writer) error {
+	mp, ok := h.Plugin.(MetricsPlugin)
+	if !ok {
+		return errNotMetricsPlugin
+	}
+	return h.writeMetricsValues(w, mp)
+}
+
+// OutputMetricsValues 采集指标并输出，出错时记录日志并以 ErrorExitCodes 对应的退出码退出进程
 func (h *IdpcPlugin) OutputMetricsValues() {
 	if mp, ok := h.Plugin.(MetricsPlugin); ok {
-		stat, err := mp.Metrics()
+		err := h.writeMetricsValues(h.out(), mp)
 		if err != nil {
-			log.Fatal().Err(err).Msg("OutputValues: ")
+			h.logger().Error().Err(err).Msg("OutputValues: ")
+			os.Exit(h.exitCode(err))
 		}
-		metricValues := PluginValues{Values: stat, Timestamp: time.Now()}
+	}
+}
 
-		lastMetricValues, err := h.loadLastValuesSafe(metricValues.Timestamp)
-		if err != nil {
-			if err == errStateUpdated {
-				log.Debug().Err(err).Msgf("OutputValues: ")
-				return
+// writeMetricsValues 采集指标并将计算后的值写入w
+func (h *IdpcPlugin) writeMetricsValues(w io.Writer, mp MetricsPlugin) (err error) {
+	if hooks, ok := mp.(CollectHooks); ok {
+		if err = hooks.PreCollect(); err != nil {
+			return fmt.Errorf("preCollect: %w", err)
+		}
+		defer func() { hooks.PostCollect(err) }()
+	}
+	// 在签名的输出写入之后执行
+	var groups []graphValues
+	defer func() {
+		if err == nil {
+			h.feedSink(groups)
+		}
+	}()
+	key, err := h.signKey()
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		out := w
+		buf := &bytes.Buffer{}
+		w = buf
+		defer func() {
+			if err == nil {
+				err = writeSigned(out, buf.Bytes(), key)
 			}
-			log.Debug().Err(err).Msgf("FetchLastValues (ignore):")
+		}()
+	}
+	start := time.Now()
+	groups, now, err := h.collectValues(mp)
+	if err != nil {
+		if isSkip(err) {
+			h.logger().Debug().Err(err).Msg("OutputValues: ")
+			h.printConstMetrics(w, h.now())
+			return nil
+		}
+		return err
+	}
+	emitted := 0
+	for _, g := range groups {
+		if h.GraphComments {
+			h.printGraphComment(w, g.key, g.graph)
 		}
+		for _, line := range g.backfill {
+			h.printLine(w, line)
+		}
+		for _, line := range g.lines {
+			h.printLine(w, line)
+		}
+		emitted += len(g.lines)
+	}
+	if h.BuildInfo {
+		h.printBuildInfo(w, now)
+	}
+	if h.EmitDropped {
+		h.printDropped(w, now)
+	}
+	if h.EmitResets {
+		h.printResets(w, now)
+	}
+	h.printConstMetrics(w, now)
+	if h.Summary {
+		fmt.Fprintf(os.Stderr, "# emitted %d metrics in %dms\n", emitted, time.Since(start).Milliseconds())
+	}
+	return nil
+}
 
-		for key, graph := range mp.GraphDefinition() {
-			for _, metric := range graph.Metrics {
-				if strings.ContainsAny(key+metric.Name, "*#") {
-					h.formatValuesWithWildcard(key, metric, metricValues, lastMetricValues)
-				} else {
-					h.formatValues(key, metric, metricValues, lastMetricValues)
-				}
-			}
+// graphValues 一个图表中计算后的指标值
+type graphValues struct {
+	key   string
+	graph Graphs
+	lines []MetricLine
+	// backfill 设置了 BackfillGauges 时上次保存的非Diff指标值
+	backfill []MetricLine
+}
+
+// isSkip 判断 collectValues 返回的错误是否表示跳过本次运行
+func isSkip(err error) bool {
+	return err == errStateUpdated || err == ErrStateLocked
+}
+
+// collectValues 采集指标，根据上次保存的状态计算差值等输出值并保存本次状态，
+// 返回按图表分组的输出值和采集时间。需要跳过本次运行时返回的错误满足 isSkip
+func (h *IdpcPlugin) collectValues(mp MetricsPlugin) ([]graphValues, time.Time, error) {
+	// 在整个 加载-计算-保存 期间持有锁
+	unlock, err := h.lockState()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer unlock()
+	h.dropped = nil
+
+	stat, err := h.fetchMetrics(mp)
+	if err != nil {
+		return nil, time.Time{}, &CollectError{Err: err}
+	}
+	metricValues := PluginValues{Values: stat, Timestamp: h.now()}
+
+	lastMetricValues, err := h.loadLastValuesSafe(metricValues.Timestamp)
+	if err != nil {
+		if err == errStateUpdated {
+			return nil, time.Time{}, err
 		}
+		h.logger().Debug().Err(err).Msgf("FetchLastValues (ignore):")
+	}
 
-		err = h.SaveValues(metricValues)
-		if err != nil {
-			log.Fatal().Err(err).Msgf("saveValues: ")
+	carryResets(lastMetricValues, metricValues)
+	if h.WindowSize > 0 {
+		updateWindows(lastMetricValues, metricValues, h.WindowSize)
+	}
+
+	defs := h.graphDefinition(mp)
+	h.wildcardIndex = h.indexWildcards(defs, metricValues.Values)
+	defer func() { h.wildcardIndex = nil }()
+
+	backfill := h.BackfillGauges && !h.backfilled && h.canBackfill(lastMetricValues.Timestamp, metricValues.Timestamp)
+	h.backfilled = true
+
+	var groups []graphValues
+	for key, graph := range defs {
+		g := graphValues{key: key, graph: graph}
+		if backfill {
+			g.backfill = h.backfillLines(key, graph, lastMetricValues)
+		}
+		for _, metric := range graph.Metrics {
+			metric = percentMetric(graph, metric)
+			g.lines = append(g.lines, h.formatMetric(key, metric, metricValues, lastMetricValues)...)
+		}
+		for _, lines := range [][]MetricLine{g.backfill, g.lines} {
+			for i := range lines {
+				lines[i].Name = h.metricName(lines[i].Name + h.unitSuffix(graph.Unit))
+			}
 		}
+		groups = append(groups, g)
+	}
+
+	h.resets = lastResets(metricValues)
+
+	// 运行被取消时不保存本次的状态
+	if err := h.runContext().Err(); err != nil {
+		return nil, time.Time{}, err
+	}
+	err = h.SaveValues(metricValues)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("saveValues: %w", err)
+	}
+	return groups, metricValues.Timestamp, nil
+}
 
+// Warmup 采集指标并保存状态但不输出任何内容，
+// 使首次部署后的下一次采集能够计算差值。保存的状态与正常运行相同(例如 time.Duration 按 DurationUnit 转换，
+// 保留重置时间和 WindowSize 的历史值)，距离上次保存不足 MinInterval 时不做任何事
+func (h *IdpcPlugin) Warmup() error {
+	mp, ok := h.Plugin.(MetricsPlugin)
+	if !ok {
+		return errNotMetricsPlugin
 	}
+	_, _, err := h.collectValues(mp)
+	if isSkip(err) {
+		h.logger().Debug().Err(err).Msg("Warmup: ")
+		return nil
+	}
+	return err
 }
 
+// printGraphComment 输出图表的注释行，格式为 "# graph: label (unit)"
+func (h *IdpcPlugin) printGraphComment(w io.Writer, key string, graph Graphs) {
+	label := graph.Label
+	if label == "" {
+		label = title(h.graphName(key))
+	}
+	fmt.Fprintf(w, "# graph: %s (%s)\n", label, graph.Unit)
+}
+
+// graphName 返回带插件key前缀的图表名称
+func (h *IdpcPlugin) graphName(key string) string {
+	prefix := h.Plugin.Meta().Key
+	if key == "" {
+		return prefix
+	}
+	return prefix + "." + key
+}
+
+var errNotMetricsPlugin = errors.New("not a metrics plugin")
+
+var errNotMetadataPlugin = errors.New("not a metadata plugin")
+
+// ErrCollectTimeout 指标采集超过 Timeout 时返回，包装在 CollectError 中
+var ErrCollectTimeout = errors.New("metrics collection timed out")
+
+// fetchMetrics 调用插件的 Metrics 方法，设置了 Timeout 时超时返回 ErrCollectTimeout。
+// 插件实现了 GraphMetricsPlugin 时按图表采集，见 fetchGraphMetrics
+func (h *IdpcPlugin) fetchMetrics(mp MetricsPlugin) (map[string]interface{}, error) {
+	if gp, ok := mp.(GraphMetricsPlugin); ok {
+		return h.fetchGraphMetrics(gp)
+	}
+	ctx := h.runContext()
+	if h.Timeout <= 0 && ctx.Done() == nil {
+		return mp.Metrics()
+	}
+	type result struct {
+		stat map[string]interface{}
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		stat, err := mp.Metrics()
+		ch <- result{stat, err}
+	}()
+	var deadline <-chan time.Time
+	if h.Timeout > 0 {
+		timer := time.NewTimer(h.Timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	select {
+	case r := <-ch:
+		return r.stat, r.err
+	case <-deadline:
+		return nil, ErrCollectTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// OutputCheckerValues 执行检查并输出消息，进程退出码由检查状态决定(OK=0, WARNING=1, CRITICAL=2, UNKNOWN=3)
 func (h *IdpcPlugin) OutputCheckerValues() {
-	if mp, ok := h.Plugin.(CheckerPlugin); ok {
-		mp.Checker()
+	if mp, ok := h.checkerPlugin(); ok {
+		os.Exit(h.writeCheckerValues(h.out(), mp))
+	}
+}
 
+// MetadataThrottle 元数据插件在状态文件刚被更新(1秒内)时的处理方式
+type MetadataThrottle int
+
+const (
+	// MetadataSkip 跳过本次输出(默认)
+	MetadataSkip MetadataThrottle = iota
+	// MetadataEmit 仍然输出元数据
+	MetadataEmit
+)
+
+// WriteMetadataValues 获取元数据并写入w，与 OutputMetadataValues 相同，
+// 但出错时返回错误而不退出进程
+func (h *IdpcPlugin) WriteMetadataValues(w io.Writer) error {
+	mp, ok := h.Plugin.(MetadataPlugin)
+	if !ok {
+		return errNotMetadataPlugin
 	}
+	return h.writeMetadataValues(w, mp)
 }
 
+// OutputMetadataValues 获取元数据并在其与上次相比发生变化时输出(见 MetadataForceEmit)，出错时记录日志并以 ErrorExitCodes 对应的退出码退出进程
 func (h *IdpcPlugin) OutputMetadataValues() {
 	if mp, ok := h.Plugin.(MetadataPlugin); ok {
-		now := time.Now()
-		preMetadata, err := h.loadLastValuesSafe(now)
-		if err != nil && errors.Is(err, errStateUpdated) {
-			return
-		}
-		metadata, err := mp.Metadata()
+		err := h.writeMetadataValues(h.out(), mp)
 		if err != nil {
-			log.Fatal().Err(err).Send()
-			return
+			h.logger().Error().Err(err).Send()
+			os.Exit(h.exitCode(err))
 		}
-		err = json.NewEncoder(os.Stdout).Encode(metadata)
-		if err != nil {
-			log.Fatal().Err(err).Send()
-			return
+	}
+}
+
+// writeMetadataValues 获取元数据，元数据发生变化时写入w并保存到状态文件
+func (h *IdpcPlugin) writeMetadataValues(w io.Writer, mp MetadataPlugin) error {
+	now := h.now()
+	preMetadata, err := h.loadLastValuesSafe(now)
+	if err != nil && errors.Is(err, errStateUpdated) {
+		if h.MetadataThrottle != MetadataEmit {
+			h.logger().Warn().Err(err).Msg("OutputMetadataValues: skipped")
+			return nil
+		}
+		h.logger().Debug().Err(err).Msg("OutputMetadataValues: emitting anyway")
+	}
+	metadata, err := mp.Metadata()
+	if err != nil {
+		return err
+	}
+	if err := h.runContext().Err(); err != nil {
+		return err
+	}
+	// 没有上次保存的状态时(首次运行)总是输出
+	changed := preMetadata.Timestamp.IsZero() || !equalMetadata(preMetadata.Values, metadata)
+	if !changed && !h.MetadataForceEmit {
+		h.logger().Debug().Msg("OutputMetadataValues: metadata unchanged")
+		return nil
+	}
+	err = json.NewEncoder(w).Encode(metadata)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return nil
+	}
+	values := metadata
+	if values == nil {
+		values = map[string]interface{}{}
+	}
+	err = h.SaveValues(PluginValues{
+		Values:    values,
+		Timestamp: now,
+	})
+	if err != nil {
+		return fmt.Errorf("saveValues: %w", err)
+	}
+	return nil
+}
+
+// equalMetadata 比较两份元数据是否相同，忽略 "_lastTime" 键。从状态文件读取的数字均为float64，
+// 因此先将两者通过JSON编码再解码后比较，使数值相等但类型不同的值(如int(5)和float64(5))视为相同
+func equalMetadata(a, b map[string]interface{}) bool {
+	na, err := normalizeMetadata(a)
+	if err != nil {
+		return false
+	}
+	nb, err := normalizeMetadata(b)
+	if err != nil {
+		return false
+	}
+	if len(na) == 0 && len(nb) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(na, nb)
+}
+
+func normalizeMetadata(m map[string]interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var v map[string]interface{}
+	err = json.Unmarshal(b, &v)
+	delete(v, "_lastTime")
+	return v, err
+}
+
+// checkBounds 检查value是否在 metric.Min 和 metric.Max 范围内，
+// 超出范围时根据 metric.Clamp 截断到边界值或丢弃(返回false)
+func (h *IdpcPlugin) checkBounds(name string, metric Metrics, value interface{}) (interface{}, bool) {
+	v := toFloat64(value)
+	var bound float64
+	switch {
+	case metric.Min != nil && v < *metric.Min:
+		bound = *metric.Min
+	case metric.Max != nil && v > *metric.Max:
+		bound = *metric.Max
+	default:
+		return value, true
+	}
+	if !metric.Clamp {
+		h.logger().Warn().Msgf("Value out of range, dropped: key = %s, value = %v", name, h.logValue(name, value))
+		return nil, false
+	}
+	h.logger().Warn().Msgf("Value out of range, clamped: key = %s, value = %v, bound = %v", name, h.logValue(name, value), bound)
+	switch value.(type) {
+	case uint32:
+		return uint32(math.Max(bound, 0)), true
+	case uint64:
+		return uint64(math.Max(bound, 0)), true
+	default:
+		return bound, true
+	}
+}
+
+const redacted = "[REDACTED]"
+
+// isSensitive 判断指标是否在 SensitiveMetrics 中
+func (h *IdpcPlugin) isSensitive(name string) bool {
+	for _, n := range h.SensitiveMetrics {
+		if n == name {
+			return true
 		}
-		if metadata != nil {
-			metadata["_lastTime"] = preMetadata.Values["_lastTime"]
+	}
+	return false
+}
+
+// logValue 返回用于日志输出的值，敏感指标的值被替换为 [REDACTED]
+func (h *IdpcPlugin) logValue(name string, value interface{}) interface{} {
+	if h.isSensitive(name) {
+		return redacted
+	}
+	return value
+}
+
+// runContext 返回本次运行的context，不是通过 RunContext 运行时返回 context.Background()
+func (h *IdpcPlugin) runContext() context.Context {
+	if h.ctx != nil {
+		return h.ctx
+	}
+	return context.Background()
+}
+
+// now 返回 Clock 给出的当前时间
+func (h *IdpcPlugin) now() time.Time {
+	if h.Clock != nil {
+		return h.Clock()
+	}
+	return time.Now()
+}
+
+// out 返回插件输出的写入目标
+func (h *IdpcPlugin) out() io.Writer {
+	if h.Out != nil {
+		return h.Out
+	}
+	return os.Stdout
+}
+
+// logger 返回插件使用的日志记录器，未设置 Logger 时使用zerolog的全局日志记录器
+func (h *IdpcPlugin) logger() *zerolog.Logger {
+	if h.Logger != nil {
+		return h.Logger
+	}
+	return &log.Logger
+}
+
+// ErrorExitCode 错误对应的进程退出码，见 IdpcPlugin.ErrorExitCodes。Err 和 As 设置其中一个
+type ErrorExitCode struct {
+	// Err 与 errors.Is 相同的方式匹配的错误，可以是不可比较的类型
+	Err error
+	// As 指向错误类型的指针，例如 new(*net.OpError)，与 errors.As 相同的方式匹配该类型的错误
+	As   interface{}
+	Code int
+}
+
+// exitCode 返回采集错误对应的退出码
+func (h *IdpcPlugin) exitCode(err error) int {
+	// 沿错误链从外向内查找，使多个错误都匹配时结果确定
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		for _, c := range h.ErrorExitCodes {
+			if c.As != nil && matchErrorAs(e, c.As) || c.Err != nil && matchError(e, c.Err) {
+				return c.Code
+			}
 		}
-		if !reflect.DeepEqual(preMetadata.Values, metadata) {
-			h.SaveValues(PluginValues{
-				Values:    metadata,
-				Timestamp: now,
-			})
+	}
+	return 1
+}
+
+// matchError 与 errors.Is 相同，但只比较err本身，不展开错误链
+func matchError(err, target error) bool {
+	if target == nil {
+		return err == target
+	}
+	if reflect.TypeOf(target).Comparable() && err == target {
+		return true
+	}
+	if x, ok := err.(interface{ Is(error) bool }); ok {
+		return x.Is(target)
+	}
+	return false
+}
+
+// matchErrorAs 与 errors.As 相同，但只检查err本身，不展开错误链，也不修改target
+func matchErrorAs(err error, target interface{}) bool {
+	typ := reflect.TypeOf(target)
+	if typ.Kind() != reflect.Ptr {
+		return false
+	}
+	if reflect.TypeOf(err).AssignableTo(typ.Elem()) {
+		return true
+	}
+	if x, ok := err.(interface{ As(interface{}) bool }); ok {
+		return x.As(reflect.New(typ.Elem()).Interface())
+	}
+	return false
+}
+
+// normalizeValue 将Metrics返回的整数统一转换为int64，uint、uint8和uint16转换为uint64，
+// bool转换为uint64的1或0，time.Duration转换为float64的秒数，
+// json.Number按其表示的数值转换为int64、uint64或float64，其它类型保持不变
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
 		}
+		if n, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return n
+		}
+		if n, err := v.Float64(); err == nil {
+			return n
+		}
+		return value
+	case time.Duration:
+		return v.Seconds()
+	case bool:
+		if v {
+			return uint64(1)
+		}
+		return uint64(0)
+	case int:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint:
+		return uint64(v)
+	case uint8:
+		return uint64(v)
+	case uint16:
+		return uint64(v)
+	default:
+		return value
+	}
+}
+
+// scaleUint64 返回v乘以scale的值，scale为正整数时使用整数乘法保持精度，
+// 否则使用浮点数计算并四舍五入，避免 0.001 等小于1的scale被截断为0
+func scaleUint64(v uint64, scale float64) uint64 {
+	if scale >= 1 && scale == math.Trunc(scale) {
+		return v * uint64(scale)
+	}
+	return uint64(math.Round(float64(v) * scale))
+}
 
+// scaleInt64 与 scaleUint64 相同，用于有符号整数
+func scaleInt64(v int64, scale float64) int64 {
+	if scale == math.Trunc(scale) {
+		return v * int64(scale)
 	}
+	return int64(math.Round(float64(v) * scale))
+}
+
+// durationValue 以unit为单位返回d，unit为0时以秒为单位
+func durationValue(d, unit time.Duration) float64 {
+	if unit <= 0 {
+		return d.Seconds()
+	}
+	return float64(d) / float64(unit)
 }
 
 func toUint32(value interface{}) uint32 {
-	switch v := value.(type) {
+	switch v := normalizeValue(value).(type) {
 	case uint32:
 		return v
 	case uint64:
 		return uint32(v)
+	case int64:
+		return uint32(v)
 	case float64:
 		return uint32(v)
 	case string:
@@ -592,11 +1745,13 @@ func toUint32(value interface{}) uint32 {
 }
 
 func toUint64(value interface{}) uint64 {
-	switch v := value.(type) {
+	switch v := normalizeValue(value).(type) {
 	case uint32:
 		return uint64(v)
 	case uint64:
 		return v
+	case int64:
+		return uint64(v)
 	case float64:
 		return uint64(v)
 	case string:
@@ -610,12 +1765,35 @@ func toUint64(value interface{}) uint64 {
 	}
 }
 
+func toInt64(value interface{}) int64 {
+	switch v := normalizeValue(value).(type) {
+	case uint32:
+		return int64(v)
+	case uint64:
+		return int64(v)
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	case string:
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0
+		}
+		return n
+	default:
+		return 0
+	}
+}
+
 func toFloat64(value interface{}) float64 {
-	switch v := value.(type) {
+	switch v := normalizeValue(value).(type) {
 	case uint32:
 		return float64(v)
 	case uint64:
 		return float64(v)
+	case int64:
+		return float64(v)
 	case float64:
 		return v
 	case string:
@@ -1,10 +1,26 @@
 package plugin
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"io"
+	"math"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseCommand(t *testing.T) {
@@ -88,3 +104,1654 @@ func TestParseVersion(t *testing.T) {
 	}
 	t.Log(version)
 }
+
+func TestParseVersionCommandFields(t *testing.T) {
+	meta := ParseVersionCommand("idpc-plugin-memcached-metrics version 1.2.3 (rev abc123) [linux amd64 go1.16]")
+	if got := meta.Platform(); got != "linux/amd64" {
+		t.Errorf("Platform() = %q", got)
+	}
+	if meta.Version != (Version{Major: 1, Minor: 2, Patch: 3}) {
+		t.Errorf("unexpected version %v", meta.Version)
+	}
+	for _, tc := range []struct {
+		other Version
+		want  int
+	}{
+		{Version{Major: 1, Minor: 2, Patch: 3}, 0},
+		{Version{Major: 1, Minor: 10, Patch: 0}, -1},
+		{Version{Major: 1, Minor: 2, Patch: 2}, 1},
+		{Version{Major: 0, Minor: 9, Patch: 9}, 1},
+	} {
+		if got := meta.Version.Compare(tc.other); got != tc.want {
+			t.Errorf("%v.Compare(%v) = %d, want %d", meta.Version, tc.other, got, tc.want)
+		}
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	var versions []Version
+	for _, s := range []string{
+		"0.0.1", "0.1.0", "0.1.2",
+		"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1",
+		"1.0.0", "1.0.10", "1.2.0", "2.0.0",
+	} {
+		v, err := ParseVersion(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, v)
+	}
+	for i, a := range versions {
+		for j, b := range versions {
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			if got := a.Compare(b); got != want {
+				t.Errorf("%v.Compare(%v) = %d, want %d", a, b, got, want)
+			}
+			if a.LessThan(b) != (a.Compare(b) < 0) {
+				t.Errorf("%v.LessThan(%v) disagrees with Compare", a, b)
+			}
+			if a.Equal(b) != (i == j) || a.GreaterThan(b) != (i > j) {
+				t.Errorf("%v.Equal/GreaterThan(%v) disagrees with Compare", a, b)
+			}
+		}
+	}
+}
+
+func TestParseVersionPreRelease(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want Version
+	}{
+		{"1.4.0", Version{Major: 1, Minor: 4}},
+		{"1.4.0-rc2", Version{Major: 1, Minor: 4, PreRelease: "rc2"}},
+		{"v2.0.0-beta.1", Version{Major: 2, PreRelease: "beta.1"}},
+	} {
+		v, err := ParseVersion(tc.in)
+		if err != nil {
+			t.Errorf("%s: %v", tc.in, err)
+			continue
+		}
+		if v != tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.in, v, tc.want)
+		}
+		if got := v.String(); got != strings.TrimPrefix(tc.in, "v") {
+			t.Errorf("%s: String() = %q", tc.in, got)
+		}
+	}
+	if _, err := ParseVersion("1.4.0-"); err == nil {
+		t.Error("expected an error for an empty pre-release")
+	}
+	rc, _ := ParseVersion("1.4.0-rc2")
+	if !rc.LessThan(Version{Major: 1, Minor: 4}) || (Version{Major: 1, Minor: 4}).LessThan(rc) {
+		t.Error("1.4.0-rc2 should be older than 1.4.0")
+	}
+	meta := ParseVersionCommand("idpc-plugin-test-metrics version 1.4.0-rc2 (rev abc) [linux amd64 go1.16]")
+	if meta.Version != rc {
+		t.Errorf("ParseVersionCommand: got %+v", meta.Version)
+	}
+}
+
+func TestMustParseVersion(t *testing.T) {
+	if v := MustParseVersion("1.2.3"); v != (Version{Major: 1, Minor: 2, Patch: 3}) {
+		t.Errorf("unexpected version %v", v)
+	}
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), `"1.2"`) {
+			t.Errorf("expected a panic mentioning the input, got %v", r)
+		}
+	}()
+	MustParseVersion("1.2")
+}
+
+func TestVersionJSON(t *testing.T) {
+	type status struct {
+		Plugin  string
+		Version Version
+	}
+	in := status{Plugin: "memcached", Version: Version{Major: 1, Minor: 4, PreRelease: "rc2"}}
+	b, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"Plugin":"memcached","Version":"1.4.0-rc2"}` {
+		t.Errorf("unexpected JSON %s", b)
+	}
+	var out status
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out != in {
+		t.Errorf("round trip: got %+v, want %+v", out, in)
+	}
+
+	for _, bad := range []string{`{"Version":"1.2"}`, `{"Version":123}`} {
+		if err := json.Unmarshal([]byte(bad), &out); err == nil {
+			t.Errorf("expected an error for %s", bad)
+		}
+	}
+}
+
+func TestSortVersions(t *testing.T) {
+	versions := []Version{MustParseVersion("3.0.0"), MustParseVersion("1.2.10"), MustParseVersion("1.2.2"), MustParseVersion("1.2.10-rc1")}
+	SortVersions(versions)
+	var got []string
+	for _, v := range versions {
+		got = append(got, v.String())
+	}
+	if strings.Join(got, " ") != "1.2.2 1.2.10-rc1 1.2.10 3.0.0" {
+		t.Errorf("unexpected order %v", got)
+	}
+}
+
+func TestParseVersionCommandNoise(t *testing.T) {
+	line := "idpc-plugin-memcached-metrics version 1.2.3 (rev abc123) [linux amd64 go1.16]"
+	for _, out := range []string{
+		line,
+		line + "\n",
+		"\n\n" + line + "\r\n",
+		"warning: config file not found\n" + line,
+		line + "\n2021/06/01 12:00:00 debug: connected to localhost:11211\n",
+	} {
+		meta := ParseVersionCommand(out)
+		if meta.Key != "memcached" || meta.GOVersion != "go1.16" || meta.Version != (Version{Major: 1, Minor: 2, Patch: 3}) {
+			t.Errorf("%q: unexpected meta %+v", out, meta)
+		}
+	}
+	if meta := ParseVersionCommand("usage: plugin [options]\n"); meta != (Meta{}) {
+		t.Errorf("expected zero Meta, got %+v", meta)
+	}
+}
+
+func TestParseVersionCommandErr(t *testing.T) {
+	if _, err := ParseVersionCommandErr("idpc-plugin-test-metrics version 1.2.3 (rev abc) [linux amd64 go1.16]"); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	noise := "usage: plugin [options]\n" + strings.Repeat("x", 200)
+	_, err := ParseVersionCommandErr(noise)
+	if !errors.Is(err, ErrVersionNoMatch) {
+		t.Fatalf("expected ErrVersionNoMatch, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "usage: plugin") || strings.Contains(err.Error(), strings.Repeat("x", 100)) {
+		t.Errorf("error should include a truncated snapshot of the input: %v", err)
+	}
+
+	// a looser regexp lets an out of range version through to ParseVersion
+	defer func(re *regexp.Regexp) { PluginVersionRegex = re }(PluginVersionRegex)
+	PluginVersionRegex = regexp.MustCompile(strings.Replace(PluginVersionRegex.String(), `\d{1,3}`, `\d+`, 1))
+	_, err = ParseVersionCommandErr("idpc-plugin-test-metrics version 99999999999.2.3 (rev abc) [linux amd64 go1.16]")
+	if err == nil || errors.Is(err, ErrVersionNoMatch) || !strings.Contains(err.Error(), "99999999999.2.3") {
+		t.Errorf("expected a version parse error, got %v", err)
+	}
+	if meta := ParseVersionCommand("idpc-plugin-test-metrics version 99999999999.2.3 (rev abc) [linux amd64 go1.16]"); meta != (Meta{}) {
+		t.Errorf("ParseVersionCommand should return zero Meta on error, got %+v", meta)
+	}
+}
+
+type testMetricsPlugin struct {
+	key    string
+	graphs map[string]Graphs
+	values map[string]interface{}
+	err    error
+	delay  time.Duration
+}
+
+func (p testMetricsPlugin) Meta() Meta {
+	return Meta{Key: p.key, Type: TypeMetrics, Version: Version{Major: 1}, Revision: "test", GOOS: runtime.GOOS, GOARCH: runtime.GOARCH, GOVersion: runtime.Version()}
+}
+
+func (p testMetricsPlugin) Metrics() (map[string]interface{}, error) {
+	time.Sleep(p.delay)
+	return p.values, p.err
+}
+
+func (p testMetricsPlugin) GraphDefinition() map[string]Graphs {
+	return p.graphs
+}
+
+// testClock sets a fixed clock on h and returns a function that advances it.
+func testClock(h *IdpcPlugin) func(time.Duration) {
+	now := time.Unix(1700000000, 0)
+	h.Clock = func() time.Time { return now }
+	return func(d time.Duration) { now = now.Add(d) }
+}
+
+func manyGraphs(n int) map[string]Graphs {
+	graphs := make(map[string]Graphs, n)
+	for i := 0; i < n; i++ {
+		graphs[fmt.Sprintf("graph%d", i)] = Graphs{
+			Unit: UnitInteger,
+			Metrics: []Metrics{
+				{Name: fmt.Sprintf("metric%d_a", i)},
+				{Name: fmt.Sprintf("metric%d_b", i), Label: "B", Stacked: true},
+			},
+		}
+	}
+	graphs[""] = Graphs{Label: "Root <&>", Unit: UnitFloat}
+	return graphs
+}
+
+// marshalMeta is the former OutputMeta implementation which builds the whole
+// graphs map before marshaling it.
+func marshalMeta(h *IdpcPlugin) string {
+	builder := strings.Builder{}
+	builder.WriteString(h.Meta().String())
+	builder.WriteString("\n")
+	if mp, ok := h.Plugin.(MetricsPlugin); ok {
+		graphs := make(map[string]Graphs)
+		for key, graph := range mp.GraphDefinition() {
+			g := graph
+			k := key
+			prefix := h.Plugin.Meta().Key
+			if k == "" {
+				k = prefix
+			} else {
+				k = prefix + "." + k
+			}
+			if g.Label == "" {
+				g.Label = title(k)
+			}
+			var metrics []Metrics
+			for _, v := range g.Metrics {
+				if v.Label == "" {
+					v.Label = title(v.Name)
+				}
+				metrics = append(metrics, v)
+			}
+			g.Metrics = metrics
+			graphs[k] = g
+		}
+		b, _ := json.Marshal(GraphDef{Graphs: graphs})
+		builder.Write(b)
+	}
+	builder.WriteString("\n")
+	return builder.String()
+}
+
+func TestWriteMetaStreaming(t *testing.T) {
+	for _, graphs := range []map[string]Graphs{nil, manyGraphs(50)} {
+		h := NewIdpcPlugin(testMetricsPlugin{key: "test", graphs: graphs})
+		buf := &bytes.Buffer{}
+		h.writeMeta(buf)
+		if want := marshalMeta(&h); buf.String() != want {
+			t.Fatalf("writeMeta output differs:\n got: %s\nwant: %s", buf.String(), want)
+		}
+	}
+}
+
+func BenchmarkOutputMetaMarshal(b *testing.B) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test", graphs: manyGraphs(5000)})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		io.WriteString(io.Discard, marshalMeta(&h))
+	}
+}
+
+func BenchmarkOutputMetaStreaming(b *testing.B) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test", graphs: manyGraphs(5000)})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w := bufio.NewWriter(io.Discard)
+		h.writeMeta(w)
+		w.Flush()
+	}
+}
+
+// buildTestPlugin compiles a testdata program, since `go run` does not
+// propagate the exit code of the program it runs.
+func buildTestPlugin(t *testing.T, src string) string {
+	t.Helper()
+	bin := filepath.Join(t.TempDir(), "plugin")
+	if runtime.GOOS == "windows" {
+		bin += ".exe"
+	}
+	out, err := exec.Command("go", "build", "-o", bin, src).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	return bin
+}
+
+func TestErrorExitCodes(t *testing.T) {
+	bin := buildTestPlugin(t, "testdata/metrics-plugin.go")
+	tempFile := filepath.Join(t.TempDir(), "state")
+	for _, tc := range []struct {
+		err  string
+		code int
+	}{
+		{"", 0},
+		{"unreachable", 3},
+		{"config", 4},
+		{"other", 1},
+	} {
+		cmd := exec.Command(bin, "-error", tc.err, "-tempFile", tempFile)
+		err := cmd.Run()
+		code := 0
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			code = exitErr.ExitCode()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if code != tc.code {
+			t.Errorf("error %q: exit code = %d, want %d", tc.err, code, tc.code)
+		}
+	}
+}
+
+// multiError matches every target in errs and wraps next.
+type multiError struct {
+	errs []error
+	next error
+}
+
+func (e multiError) Error() string { return "multi" }
+
+func (e multiError) Unwrap() error { return e.next }
+
+func (e multiError) Is(target error) bool {
+	for _, err := range e.errs {
+		if err == target {
+			return true
+		}
+	}
+	return false
+}
+
+func TestExitCodePrecedence(t *testing.T) {
+	errOuter := errors.New("outer")
+	errInner := errors.New("inner")
+	errOther := errors.New("other")
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	h.ErrorExitCodes = []ErrorExitCode{
+		{Err: errInner, Code: 3},
+		{Err: errOther, Code: 4},
+		{Err: errOuter, Code: 5},
+	}
+	chain := fmt.Errorf("collect: %w", multiError{errs: []error{errOuter}, next: errInner})
+	if code := h.exitCode(chain); code != 5 {
+		t.Errorf("wrapped chain: exit code = %d, want the outermost match 5", code)
+	}
+	if code := h.exitCode(multiError{errs: []error{errOuter, errOther}}); code != 4 {
+		t.Errorf("same level: exit code = %d, want the first entry 4", code)
+	}
+	if code := h.exitCode(&CollectError{Err: fmt.Errorf("dial: %w", errInner)}); code != 3 {
+		t.Errorf("collect error: exit code = %d, want 3", code)
+	}
+	if code := h.exitCode(errors.New("unknown")); code != 1 {
+		t.Errorf("unmatched: exit code = %d, want 1", code)
+	}
+}
+
+// fieldsError is not comparable, comparing two of them with == panics.
+type fieldsError struct {
+	fields []string
+}
+
+func (e fieldsError) Error() string { return "invalid fields " + strings.Join(e.fields, ",") }
+
+func TestExitCodeErrorType(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	h.ErrorExitCodes = []ErrorExitCode{
+		{Err: fieldsError{fields: []string{"a"}}, Code: 3},
+		{As: new(fieldsError), Code: 6},
+		{As: new(*CollectError), Code: 7},
+	}
+	err := fmt.Errorf("parse: %w", fieldsError{fields: []string{"a", "b"}})
+	if code := h.exitCode(err); code != 6 {
+		t.Errorf("wrapped error type: exit code = %d, want 6", code)
+	}
+	if code := h.exitCode(&CollectError{Err: err}); code != 7 {
+		t.Errorf("outer error type: exit code = %d, want 7", code)
+	}
+	if code := h.exitCode(errors.New("unknown")); code != 1 {
+		t.Errorf("unmatched: exit code = %d, want 1", code)
+	}
+}
+
+func TestCheckBounds(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	percentage := Metrics{Name: "p", Min: Bound(0), Max: Bound(100)}
+	for _, tc := range []struct {
+		clamp bool
+		value interface{}
+		want  interface{}
+		ok    bool
+	}{
+		{false, 50.0, 50.0, true},
+		{false, 1000.0, nil, false},
+		{false, -1.0, nil, false},
+		{true, 1000.0, 100.0, true},
+		{true, -1.0, 0.0, true},
+		{true, uint64(1000), uint64(100), true},
+		{true, uint32(1000), uint32(100), true},
+	} {
+		metric := percentage
+		metric.Clamp = tc.clamp
+		got, ok := h.checkBounds("p", metric, tc.value)
+		if ok != tc.ok || got != tc.want {
+			t.Errorf("checkBounds(clamp=%v, %v) = %v, %v; want %v, %v", tc.clamp, tc.value, got, ok, tc.want, tc.ok)
+		}
+	}
+
+	if got, ok := h.checkBounds("n", Metrics{Name: "n"}, -5.0); !ok || got != -5.0 {
+		t.Errorf("unbounded metric should pass through, got %v, %v", got, ok)
+	}
+}
+
+func TestFormatValuesAllowDecrease(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	now := time.Unix(1700000060, 0)
+	last := PluginValues{Values: map[string]interface{}{"queue": 20.0}, Timestamp: now.Add(-time.Minute)}
+
+	for _, tc := range []struct {
+		metric Metrics
+		want   string
+	}{
+		{Metrics{Name: "queue", Diff: true}, ""},
+		{Metrics{Name: "queue", Diff: true, AllowDecrease: true}, "test.g.queue\t-10.000000\t1700000060\n"},
+		{Metrics{Name: "queue", Diff: true, AllowDecrease: true, Type: metricTypeUint64}, "test.g.queue\t-10.000000\t1700000060\n"},
+	} {
+		buf := &bytes.Buffer{}
+		cur := PluginValues{Values: map[string]interface{}{"queue": 10.0}, Timestamp: now}
+		if line, ok := h.formatValues("g", tc.metric, cur, last); ok {
+			h.printLine(buf, line)
+		}
+		if buf.String() != tc.want {
+			t.Errorf("%+v: got %q, want %q", tc.metric, buf.String(), tc.want)
+		}
+	}
+}
+
+func TestGraphComments(t *testing.T) {
+	p := testMetricsPlugin{
+		key: "test",
+		graphs: map[string]Graphs{
+			"mem": {Label: "Memory", Unit: UnitBytes, Metrics: []Metrics{{Name: "used"}}},
+		},
+		values: map[string]interface{}{"used": 1.0},
+	}
+	for _, enabled := range []bool{false, true} {
+		h := NewIdpcPlugin(p)
+		h.TempFile = filepath.Join(t.TempDir(), "state")
+		h.GraphComments = enabled
+		buf := &bytes.Buffer{}
+		if err := h.writeMetricsValues(buf, p); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		hasComment := lines[0] == "# graph: Memory (bytes)"
+		if hasComment != enabled {
+			t.Errorf("GraphComments=%v: unexpected output %q", enabled, buf.String())
+		}
+		if !strings.HasPrefix(lines[len(lines)-1], "test.mem.used\t") {
+			t.Errorf("GraphComments=%v: metric line missing in %q", enabled, buf.String())
+		}
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	values := map[string]interface{}{"requests": 100.0}
+	p := testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"": {Metrics: []Metrics{{Name: "requests", Diff: true}}}},
+		values: values,
+	}
+	h := NewIdpcPlugin(p)
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	advance := testClock(&h)
+
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	err = h.Warmup()
+	os.Stdout = stdout
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := io.ReadAll(r); len(out) != 0 {
+		t.Errorf("warmup should not output anything, got %q", out)
+	}
+
+	last, err := h.LoadLastValues()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Values["requests"] != 100.0 {
+		t.Fatalf("warmup did not save state: %v", last.Values)
+	}
+
+	advance(time.Minute)
+	values["requests"] = 160.0
+	buf := &bytes.Buffer{}
+	if err := h.writeMetricsValues(buf, p); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "test.requests\t60.000000\t") {
+		t.Errorf("expected a diff after warmup, got %q", buf.String())
+	}
+}
+
+func TestWarmupState(t *testing.T) {
+	p := testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"": {Metrics: []Metrics{{Name: "busy", Diff: true}}}},
+		values: map[string]interface{}{"busy": 90 * time.Second},
+	}
+	h := NewIdpcPlugin(p)
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	h.WindowSize = 5
+	advance := testClock(&h)
+	last := PluginValues{
+		Values:    map[string]interface{}{lastResetPrefix + "other": 1600000000.0, windowPrefix + "busy": []interface{}{80.0}},
+		Timestamp: h.now().Add(-time.Minute),
+	}
+	if err := h.SaveValues(last); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Warmup(); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := h.LoadLastValues()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Values["busy"] != 90.0 {
+		t.Errorf("warmup should save durations in seconds, got %v", saved.Values["busy"])
+	}
+	if window, _ := saved.Values[windowPrefix+"busy"].([]interface{}); saved.Values[lastResetPrefix+"other"] == nil || len(window) != 2 {
+		t.Errorf("warmup dropped the reset and window state: %v", saved.Values)
+	}
+
+	advance(time.Minute)
+	buf := &bytes.Buffer{}
+	if err := h.writeMetricsValues(buf, p); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "test.busy\t0.000000\t") {
+		t.Errorf("expected a zero diff after warmup, got %q", buf.String())
+	}
+	if _, ok := h.resets["busy"]; ok {
+		t.Errorf("unexpected counter reset after warmup: %v", h.resets)
+	}
+}
+
+func TestSensitiveMetrics(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := log.Logger
+	log.Logger = zerolog.New(buf).Level(zerolog.DebugLevel)
+	defer func() { log.Logger = logger }()
+
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	h.SensitiveMetrics = []string{"password"}
+	values := PluginValues{
+		Values:    map[string]interface{}{"password": "hunter2", "other": "plain"},
+		Timestamp: time.Now(),
+	}
+	h.formatValues("", Metrics{Name: "password"}, values, PluginValues{})
+	if out := buf.String(); strings.Contains(out, "hunter2") || !strings.Contains(out, redacted) {
+		t.Errorf("sensitive value is not redacted: %s", out)
+	}
+
+	buf.Reset()
+	h.formatValues("", Metrics{Name: "other"}, values, PluginValues{})
+	if out := buf.String(); !strings.Contains(out, "plain") {
+		t.Errorf("non-sensitive value should be logged: %s", out)
+	}
+}
+
+func TestFormatValuesRound(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	values := PluginValues{Values: map[string]interface{}{"ratio": 0.4567, "neg": -0.0126}, Timestamp: time.Unix(1700000000, 0)}
+	for _, tc := range []struct {
+		metric Metrics
+		want   string
+	}{
+		{Metrics{Name: "ratio", Scale: 1000}, "test.ratio\t456.700000\t1700000000\n"},
+		{Metrics{Name: "ratio", Scale: 1000, Round: true}, "test.ratio\t457\t1700000000\n"},
+		{Metrics{Name: "neg", Scale: 1000, Round: true}, "test.neg\t-13\t1700000000\n"},
+	} {
+		buf := &bytes.Buffer{}
+		if line, ok := h.formatValues("", tc.metric, values, PluginValues{}); ok {
+			h.printLine(buf, line)
+		}
+		if buf.String() != tc.want {
+			t.Errorf("%+v: got %q, want %q", tc.metric, buf.String(), tc.want)
+		}
+	}
+}
+
+func TestInjectedLogger(t *testing.T) {
+	global := &bytes.Buffer{}
+	logger := log.Logger
+	log.Logger = zerolog.New(global)
+	defer func() { log.Logger = logger }()
+
+	buf := &bytes.Buffer{}
+	injected := zerolog.New(buf).Level(zerolog.DebugLevel)
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	h.Logger = &injected
+	values := PluginValues{Values: map[string]interface{}{"nan": math.NaN()}, Timestamp: time.Now()}
+	h.formatValues("", Metrics{Name: "nan"}, values, PluginValues{})
+	h.formatValues("", Metrics{Name: "nan", Diff: true}, values, PluginValues{})
+
+	if !strings.Contains(buf.String(), "Invalid value: key = nan") || !strings.Contains(buf.String(), "does not exist at last fetch") {
+		t.Errorf("expected logs in the injected logger, got %q", buf.String())
+	}
+	if global.Len() != 0 {
+		t.Errorf("global logger should not be used, got %q", global.String())
+	}
+}
+
+func TestPrintValueUnsupportedType(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := zerolog.New(buf)
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	h.Logger = &logger
+	out := &bytes.Buffer{}
+	h.printValue(out, "test.obj", struct{ A int }{1}, time.Now())
+	if out.Len() != 0 {
+		t.Errorf("unsupported value should not be printed, got %q", out.String())
+	}
+	if !strings.Contains(buf.String(), `"level":"warn"`) || !strings.Contains(buf.String(), "key = test.obj, type = struct { A int }") {
+		t.Errorf("expected a warning with the key and type, got %q", buf.String())
+	}
+}
+
+func TestFormatValuesTimestampOffset(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	now := time.Unix(1700000060, 0)
+	values := PluginValues{Values: map[string]interface{}{"a": 1.0, "b": 2.0}, Timestamp: now}
+	buf := &bytes.Buffer{}
+	for _, metric := range []Metrics{{Name: "a", TimestampOffset: 5 * time.Second}, {Name: "b"}} {
+		if line, ok := h.formatValues("", metric, values, PluginValues{}); ok {
+			h.printLine(buf, line)
+		}
+	}
+	if want := "test.a\t1.000000\t1700000055\ntest.b\t2.000000\t1700000060\n"; buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
+
+type testCombinedPlugin struct {
+	testMetricsPlugin
+}
+
+func (p testCombinedPlugin) Checker() (message string, status Status) {
+	return "ok", StatusOK
+}
+
+func (p testCombinedPlugin) Metadata() (map[string]interface{}, error) {
+	return map[string]interface{}{"role": "primary"}, nil
+}
+
+func TestModeEnvVar(t *testing.T) {
+	defer os.Unsetenv(PLUGIN_MODE_ENV_VAR)
+	p := testCombinedPlugin{testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"": {Metrics: []Metrics{{Name: "value"}}}},
+		values: map[string]interface{}{"value": 1.0},
+	}}
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		env  string
+		mode Type
+		out  string
+	}{
+		{"", TypeMetrics, "test.value\t1.000000\t"},
+		{"metrics", TypeMetrics, "test.value\t1.000000\t"},
+		{"METADATA", TypeMetadata, `{"role":"primary"}`},
+		{"bogus", TypeMetrics, "test.value\t1.000000\t"},
+	} {
+		os.Setenv(PLUGIN_MODE_ENV_VAR, tc.env)
+		h := NewIdpcPlugin(p)
+		h.TempFile = filepath.Join(dir, string(tc.mode)+tc.env)
+		if got := h.mode(); got != tc.mode {
+			t.Errorf("%s=%q: mode = %s, want %s", PLUGIN_MODE_ENV_VAR, tc.env, got, tc.mode)
+		}
+		out := &bytes.Buffer{}
+		h.Out = out
+		h.OutputValues()
+		if !strings.HasPrefix(out.String(), tc.out) {
+			t.Errorf("%s=%q: unexpected output %q", PLUGIN_MODE_ENV_VAR, tc.env, out)
+		}
+	}
+
+	os.Setenv(PLUGIN_MODE_ENV_VAR, "metrics")
+	h := NewIdpcPlugin(p)
+	h.Mode = TypeMetadata
+	if got := h.mode(); got != TypeMetadata {
+		t.Errorf("Mode should take precedence over the env var, got %s", got)
+	}
+
+	// checker output exits the process, so run the checker modes in a subprocess
+	bin := buildTestPlugin(t, "testdata/checker-plugin.go")
+	for _, tc := range []struct {
+		env  string
+		out  string
+		code int
+	}{
+		{"checker", "disk 91% full\n", 1},
+		{"metadata", "", 0},
+	} {
+		cmd := exec.Command(bin, "-status", "WARNING", "-message", "disk 91% full")
+		cmd.Env = append(os.Environ(), PLUGIN_MODE_ENV_VAR+"="+tc.env)
+		out, err := cmd.Output()
+		code := 0
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			code = exitErr.ExitCode()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != tc.out || code != tc.code {
+			t.Errorf("%s=%s: got %q exit %d, want %q exit %d", PLUGIN_MODE_ENV_VAR, tc.env, out, code, tc.out, tc.code)
+		}
+	}
+}
+
+func TestOutputMetaOut(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"": {Label: "Test", Metrics: []Metrics{{Name: "value"}}}},
+	})
+	out := &bytes.Buffer{}
+	h.Out = out
+	h.OutputMeta()
+	want := &bytes.Buffer{}
+	h.writeMeta(want)
+	if out.Len() == 0 || out.String() != want.String() {
+		t.Errorf("OutputMeta wrote %q, want %q", out.String(), want.String())
+	}
+}
+
+func TestMinInterval(t *testing.T) {
+	p := testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"": {Metrics: []Metrics{{Name: "value"}}}},
+		values: map[string]interface{}{"value": 1.0},
+	}
+	run := func(h *IdpcPlugin) string {
+		buf := &bytes.Buffer{}
+		if err := h.writeMetricsValues(buf, p); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	h := NewIdpcPlugin(p)
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	if h.MinInterval != time.Second {
+		t.Errorf("default MinInterval = %s, want 1s", h.MinInterval)
+	}
+	h.MinInterval = time.Hour
+	run(&h)
+	if out := run(&h); out != "" {
+		t.Errorf("run within MinInterval should be skipped, got %q", out)
+	}
+
+	h.MinInterval = 100 * time.Millisecond
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	run(&h)
+	time.Sleep(150 * time.Millisecond)
+	if out := run(&h); out == "" {
+		t.Error("run after MinInterval should emit")
+	}
+
+	h.MinInterval = 0
+	if out := run(&h); out == "" {
+		t.Error("MinInterval 0 should not skip")
+	}
+}
+
+func TestIntegerValues(t *testing.T) {
+	values := map[string]interface{}{
+		"int": 1, "int8": int8(-2), "int16": int16(3), "int32": int32(-4), "int64": int64(5),
+		"uint": uint(6), "uint8": uint8(7), "uint16": uint16(8), "uint32": uint32(9), "uint64": uint64(10),
+	}
+	var metrics []Metrics
+	for name := range values {
+		metrics = append(metrics, Metrics{Name: name})
+	}
+	h := NewIdpcPlugin(testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"": {Metrics: append(metrics, Metrics{Name: "int", Scale: 2.5})}},
+		values: values,
+	})
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	buf := &bytes.Buffer{}
+	if err := h.writeMetricsValues(buf, h.Plugin.(MetricsPlugin)); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"test.int\t1\t", "test.int8\t-2\t", "test.int16\t3\t", "test.int32\t-4\t", "test.int64\t5\t",
+		"test.uint\t6\t", "test.uint8\t7\t", "test.uint16\t8\t", "test.uint32\t9\t", "test.uint64\t10\t",
+		"test.int\t2.500000\t",
+	} {
+		if !strings.Contains(buf.String(), "\n"+want) && !strings.HasPrefix(buf.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, buf.String())
+		}
+	}
+
+	buf.Reset()
+	h.printValue(buf, "direct", 42, time.Unix(1700000000, 0))
+	if buf.String() != "direct\t42\t1700000000\n" {
+		t.Errorf("printValue(int) = %q", buf.String())
+	}
+}
+
+func TestBoolValues(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{
+		key: "test",
+		graphs: map[string]Graphs{"replication": {Metrics: []Metrics{
+			{Name: "primary"}, {Name: "healthy"}, {Name: "flaps", Diff: true},
+		}}},
+		values: map[string]interface{}{"primary": true, "healthy": false, "flaps": true},
+	})
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	advance := testClock(&h)
+	last := PluginValues{Values: map[string]interface{}{"flaps": false}, Timestamp: h.now()}
+	if err := h.SaveValues(last); err != nil {
+		t.Fatal(err)
+	}
+	advance(time.Minute)
+	buf := &bytes.Buffer{}
+	if err := h.writeMetricsValues(buf, h.Plugin.(MetricsPlugin)); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(buf.String(), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "test.replication.primary\t1\t") ||
+		!strings.HasPrefix(lines[1], "test.replication.healthy\t0\t") ||
+		!strings.HasPrefix(lines[2], "test.replication.flaps\t1.000000\t") {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+	if toFloat64(true) != 1 || toUint32(false) != 0 || toUint64(true) != 1 {
+		t.Error("to* helpers should map bool to 1 and 0")
+	}
+}
+
+func TestDurationValues(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{
+		key: "test",
+		graphs: map[string]Graphs{"latency": {Metrics: []Metrics{
+			{Name: "p50"}, {Name: "p99", DurationUnit: time.Millisecond}, {Name: "busy", Diff: true},
+		}}},
+		values: map[string]interface{}{"p50": 1500 * time.Millisecond, "p99": 1500 * time.Millisecond, "busy": 3 * time.Second},
+	})
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	last := PluginValues{Values: map[string]interface{}{"busy": 3.0}, Timestamp: time.Now().Add(-time.Minute)}
+	if err := h.SaveValues(last); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := h.writeMetricsValues(buf, h.Plugin.(MetricsPlugin)); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(buf.String(), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "test.latency.p50\t1.500000\t") ||
+		!strings.HasPrefix(lines[1], "test.latency.p99\t1500.000000\t") ||
+		!strings.HasPrefix(lines[2], "test.latency.busy\t0.000000\t") {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+
+	// the state keeps the converted value so the next diff uses the same unit
+	values, err := h.LoadLastValues()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values.Values["busy"] != 3.0 {
+		t.Errorf("saved busy = %v, want 3", values.Values["busy"])
+	}
+	if toFloat64(1500*time.Millisecond) != 1.5 {
+		t.Error("toFloat64 should convert durations to seconds")
+	}
+}
+
+func TestJSONNumberValues(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{
+		key: "test",
+		graphs: map[string]Graphs{"api": {Metrics: []Metrics{
+			{Name: "count"}, {Name: "ratio"}, {Name: "big"}, {Name: "scaled", Scale: 2}, {Name: "requests", Diff: true},
+		}}},
+		values: map[string]interface{}{
+			"count":    json.Number("42"),
+			"ratio":    json.Number("1.5"),
+			"big":      json.Number("18446744073709551615"),
+			"scaled":   json.Number("42"),
+			"requests": json.Number("42"),
+		},
+	})
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	advance := testClock(&h)
+	last := PluginValues{Values: map[string]interface{}{"requests": json.Number("30")}, Timestamp: h.now()}
+	if err := h.SaveValues(last); err != nil {
+		t.Fatal(err)
+	}
+	advance(time.Minute)
+	buf := &bytes.Buffer{}
+	if err := h.writeMetricsValues(buf, h.Plugin.(MetricsPlugin)); err != nil {
+		t.Fatal(err)
+	}
+	want := "test.api.count\t42\t1700000060\n" +
+		"test.api.ratio\t1.500000\t1700000060\n" +
+		"test.api.big\t18446744073709551615\t1700000060\n" +
+		"test.api.scaled\t84.000000\t1700000060\n" +
+		"test.api.requests\t12.000000\t1700000060\n"
+	if buf.String() != want {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+	if toUint32(json.Number("7")) != 7 || toUint64(json.Number("7")) != 7 || toFloat64(json.Number("0.5")) != 0.5 {
+		t.Error("to* helpers should parse json.Number")
+	}
+}
+
+func TestClock(t *testing.T) {
+	values := map[string]interface{}{"gauge": uint64(7), "requests": uint64(100)}
+	h := NewIdpcPlugin(testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"": {Metrics: []Metrics{{Name: "gauge"}, {Name: "requests", Diff: true, Type: "uint64"}}}},
+		values: values,
+	})
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	now := time.Unix(1700000000, 0)
+	h.Clock = func() time.Time { return now }
+
+	buf := &bytes.Buffer{}
+	if err := h.writeMetricsValues(buf, h.Plugin.(MetricsPlugin)); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "test.gauge\t7\t1700000000\n" {
+		t.Errorf("first run output = %q", buf.String())
+	}
+
+	// with a fixed clock the diff interval is exactly one minute
+	now = now.Add(time.Minute)
+	values["requests"] = uint64(160)
+	buf.Reset()
+	if err := h.writeMetricsValues(buf, h.Plugin.(MetricsPlugin)); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "test.gauge\t7\t1700000060\ntest.requests\t60.000000\t1700000060\n" {
+		t.Errorf("second run output = %q", buf.String())
+	}
+}
+
+func TestAbsoluteName(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	values := PluginValues{
+		Values: map[string]interface{}{
+			"disk.used": 10.0, "used": 20.0,
+			"disk.sda.read": 1.0, "disk.sdb.read": 2.0,
+		},
+		Timestamp: time.Unix(1700000000, 0),
+	}
+	for _, tc := range []struct {
+		metric Metrics
+		want   []string
+	}{
+		// relative: the value is read from "used" and named under the graph key
+		{Metrics{Name: "used"}, []string{"test.disk.used"}},
+		// absolute: the value is read from "disk.used" and named without the graph key
+		{Metrics{Name: "used", AbsoluteName: true}, []string{"test.used"}},
+		{Metrics{Name: "*.read"}, []string{"test.disk.sda.read", "test.disk.sdb.read"}},
+		{Metrics{Name: "*.read", AbsoluteName: true}, []string{"test.sda.read", "test.sdb.read"}},
+	} {
+		var names []string
+		for _, line := range h.formatMetric("disk", tc.metric, values, PluginValues{}) {
+			names = append(names, line.Name)
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, tc.want) {
+			t.Errorf("%+v: names = %v, want %v", tc.metric, names, tc.want)
+		}
+	}
+
+	line, ok := h.formatValues("disk", Metrics{Name: "used", AbsoluteName: true}, values, PluginValues{})
+	if !ok || line.Value != 10.0 {
+		t.Errorf("absolute value = %v, %v, want 10", line.Value, ok)
+	}
+}
+
+func TestRunContextCancel(t *testing.T) {
+	p := testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"": {Metrics: []Metrics{{Name: "value"}}}},
+		values: map[string]interface{}{"value": 1.0},
+		delay:  5 * time.Second,
+	}
+	h := NewIdpcPlugin(p)
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	ctx, cancel := context.WithCancel(context.Background())
+	h.ctx = ctx
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	buf := &bytes.Buffer{}
+	if err := h.writeMetricsValues(buf, p); !errors.Is(err, context.Canceled) {
+		t.Errorf("writeMetricsValues error = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancellation should stop the collection, took %s", elapsed)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("cancelled run should not emit, got %q", buf.String())
+	}
+	if _, err := os.Stat(h.TempFile); !os.IsNotExist(err) {
+		t.Errorf("cancelled run should not save state: %v", err)
+	}
+}
+
+func TestWriteValuesErrors(t *testing.T) {
+	errBackend := errors.New("backend unavailable")
+	p := testCombinedPlugin{testMetricsPlugin{key: "test", err: errBackend}}
+	h := NewIdpcPlugin(p)
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	buf := &bytes.Buffer{}
+	if err := h.WriteMetricsValues(buf); !errors.Is(err, errBackend) {
+		t.Errorf("WriteMetricsValues error = %v, want %v", err, errBackend)
+	}
+	if err := h.WriteMetadataValues(buf); err != nil || buf.String() != "{\"role\":\"primary\"}\n" {
+		t.Errorf("WriteMetadataValues = %q, %v", buf.String(), err)
+	}
+
+	h = NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	if err := h.WriteMetadataValues(buf); err != errNotMetadataPlugin {
+		t.Errorf("WriteMetadataValues error = %v, want %v", err, errNotMetadataPlugin)
+	}
+}
+
+func TestFormatValuesScaleUint(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	values := PluginValues{
+		Values: map[string]interface{}{
+			"bytes": uint64(1536000),
+			"small": uint32(1500),
+			"max":   uint64(math.MaxUint64 / 4),
+		},
+		Timestamp: time.Unix(1700000000, 0),
+	}
+	for _, tc := range []struct {
+		metric Metrics
+		want   string
+	}{
+		{Metrics{Name: "bytes", Type: metricTypeUint64, Scale: 1.0 / 1024}, "test.bytes\t1500\t1700000000\n"},
+		{Metrics{Name: "small", Type: metricTypeUint32, Scale: 0.001}, "test.small\t2\t1700000000\n"},
+		{Metrics{Name: "small", Type: metricTypeUint32, Scale: 0.5}, "test.small\t750\t1700000000\n"},
+		{Metrics{Name: "small", Type: metricTypeUint32, Scale: 8}, "test.small\t12000\t1700000000\n"},
+		// integral scales keep the exact integer product
+		{Metrics{Name: "max", Type: metricTypeUint64, Scale: 3}, "test.max\t13835058055282163709\t1700000000\n"},
+	} {
+		buf := &bytes.Buffer{}
+		if line, ok := h.formatValues("", tc.metric, values, PluginValues{}); ok {
+			h.printLine(buf, line)
+		}
+		if buf.String() != tc.want {
+			t.Errorf("%+v: got %q, want %q", tc.metric, buf.String(), tc.want)
+		}
+	}
+}
+
+func TestCalcDiffInt64(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	now := time.Unix(1700000060, 0)
+	last := now.Add(-time.Minute)
+
+	if v, err := h.calcDiffInt64(150, now, 100, last); err != nil || v != 50 {
+		t.Errorf("int64 increase = %v, %v, want 50", v, err)
+	}
+	// a small decrease is a legitimate negative diff
+	if v, err := h.calcDiffInt64(90, now, 100, last); err != nil || v != -10 {
+		t.Errorf("int64 small decrease = %v, %v, want -10", v, err)
+	}
+	if v, err := h.calcDiffInt64(-110, now, -100, last); err != nil || v != -10 {
+		t.Errorf("int64 negative decrease = %v, %v, want -10", v, err)
+	}
+	// a large drop is treated as a counter reset
+	if _, err := h.calcDiffInt64(10, now, 100, last); err != errCounterReset {
+		t.Errorf("int64 reset error = %v, want %v", err, errCounterReset)
+	}
+}
+
+func TestCalcDiffOutOfOrder(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	last := time.Unix(1700000060, 0)
+	now := last.Add(-30 * time.Second)
+	if _, err := h.calcDiff(20, now, 10, last); err != errOutOfOrder {
+		t.Errorf("calcDiff error = %v, want %v", err, errOutOfOrder)
+	}
+	if _, err := h.calcDiffUint32(20, now, 10, last, 0, ResetWrapPlausible); err != errOutOfOrder {
+		t.Errorf("calcDiffUint32 error = %v, want %v", err, errOutOfOrder)
+	}
+	if _, err := h.calcDiffUint64(20, now, 10, last, 0, ResetWrapPlausible); err != errOutOfOrder {
+		t.Errorf("calcDiffUint64 error = %v, want %v", err, errOutOfOrder)
+	}
+	if _, err := h.calcDiffGauge(20, now, 10, last); err != errOutOfOrder {
+		t.Errorf("calcDiffGauge error = %v, want %v", err, errOutOfOrder)
+	}
+
+	// a backfilled run is skipped cleanly
+	values := PluginValues{Values: map[string]interface{}{"counter": 20.0}, Timestamp: now}
+	lastValues := PluginValues{Values: map[string]interface{}{"counter": 10.0}, Timestamp: last}
+	if _, ok := h.formatValues("", Metrics{Name: "counter", Diff: true}, values, lastValues); ok {
+		t.Error("out of order diff should be skipped")
+	}
+	if h.Dropped()[DropOutOfOrder] != 1 {
+		t.Errorf("Dropped = %v", h.Dropped())
+	}
+}
+
+func TestCalcDiffSameTimestamp(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	last := time.Unix(1700000060, 0)
+	// the same second at a different sub-second offset
+	now := last.Add(300 * time.Millisecond)
+	for name, calc := range map[string]func() (float64, error){
+		"calcDiff":       func() (float64, error) { return h.calcDiff(20, now, 10, last) },
+		"calcDiffGauge":  func() (float64, error) { return h.calcDiffGauge(20, now, 10, last) },
+		"calcDiffUint32": func() (float64, error) { return h.calcDiffUint32(20, now, 10, last, 0, ResetWrapPlausible) },
+		"calcDiffUint64": func() (float64, error) { return h.calcDiffUint64(20, now, 10, last, 0, ResetWrapPlausible) },
+	} {
+		v, err := calc()
+		if err != errSameTimestamp {
+			t.Errorf("%s error = %v, want %v", name, err, errSameTimestamp)
+		}
+		if v != 0 {
+			t.Errorf("%s returned %v with the error", name, v)
+		}
+	}
+}
+
+func TestMaxDiffDuration(t *testing.T) {
+	now := time.Unix(1700000900, 0)
+	last := now.Add(-15 * time.Minute)
+	for _, tc := range []struct {
+		max  time.Duration
+		want error
+	}{
+		{0, errTooLongDuration},
+		{20 * time.Minute, nil},
+		{10 * time.Minute, errTooLongDuration},
+		{-1, nil},
+	} {
+		h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+		h.MaxDiffDuration = tc.max
+		v, err := h.calcDiff(1000, now, 100, last)
+		if err != tc.want {
+			t.Errorf("MaxDiffDuration %v: error = %v, want %v", tc.max, err, tc.want)
+		}
+		if err == nil && v != 60 {
+			t.Errorf("MaxDiffDuration %v: diff = %v, want 60", tc.max, v)
+		}
+	}
+}
+
+func TestCalcDiffWraparound(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	now := time.Unix(1700000060, 0)
+	last := now.Add(-time.Minute)
+
+	// a true wrap: the counter passed its maximum once
+	if v, err := h.calcDiffUint32(10, now, math.MaxUint32-5, last, 0, ResetWrapPlausible); err != nil || v != 16 {
+		t.Errorf("uint32 wrap = %v, %v, want 16", v, err)
+	}
+	if v, err := h.calcDiffUint64(10, now, math.MaxUint64-5, last, 0, ResetWrapPlausible); err != nil || v != 16 {
+		t.Errorf("uint64 wrap = %v, %v, want 16", v, err)
+	}
+	if v, err := h.calcDiffUint32(10, now, math.MaxUint32-5, last, 10, ResetWrapPlausible); err != nil || v != 16 {
+		t.Errorf("uint32 wrap with a last diff = %v, %v, want 16", v, err)
+	}
+
+	// a genuine reset: the counter restarted from zero
+	if _, err := h.calcDiffUint32(10, now, 1000, last, 0, ResetWrapPlausible); err != errCounterReset {
+		t.Errorf("uint32 reset error = %v, want %v", err, errCounterReset)
+	}
+	if _, err := h.calcDiffUint64(10, now, 1000, last, 0, ResetWrapPlausible); err != errCounterReset {
+		t.Errorf("uint64 reset error = %v, want %v", err, errCounterReset)
+	}
+	if _, err := h.calcDiffUint32(0, now, 3000000000, last, 100, ResetWrapPlausible); err != errCounterReset {
+		t.Errorf("uint32 reset with a last diff error = %v, want %v", err, errCounterReset)
+	}
+
+	// large increments do not overflow the per-minute calculation
+	if v, err := h.calcDiffUint32(200000000, now, 100000000, last, 0, ResetWrapPlausible); err != nil || v != 100000000 {
+		t.Errorf("uint32 large diff = %v, %v", v, err)
+	}
+}
+
+func TestFormatValuesRatePerSecond(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	now := time.Unix(1700000120, 0)
+	values := PluginValues{Values: map[string]interface{}{"bytes": 10000.0, "packets": uint64(900)}, Timestamp: now}
+	last := PluginValues{Values: map[string]interface{}{"bytes": 4000.0, "packets": uint64(300)}, Timestamp: now.Add(-2 * time.Minute)}
+	for _, tc := range []struct {
+		metric Metrics
+		want   float64
+	}{
+		{Metrics{Name: "bytes", Diff: true}, 3000},
+		{Metrics{Name: "bytes", Diff: true, RatePerSecond: true}, 50},
+		{Metrics{Name: "packets", Diff: true, Type: metricTypeUint64, RatePerSecond: true}, 5},
+		{Metrics{Name: "bytes", Diff: true, AllowDecrease: true, RatePerSecond: true}, 50},
+	} {
+		line, ok := h.formatValues("", tc.metric, values, last)
+		if !ok || line.Value != tc.want {
+			t.Errorf("%+v: got %v (%v), want %v", tc.metric, line.Value, ok, tc.want)
+		}
+		if values.Values[".last_diff."+tc.metric.Name] != tc.want*60 && tc.metric.RatePerSecond {
+			t.Errorf("%+v: the saved last diff should stay per minute: %v", tc.metric, values.Values[".last_diff."+tc.metric.Name])
+		}
+	}
+}
+
+func TestRedactVersion(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	h.RedactVersion = true
+	v := h.Version()
+	if strings.Contains(v, runtime.Version()) || strings.Contains(v, "(rev test)") {
+		t.Errorf("version is not redacted: %s", v)
+	}
+	m := ParseVersionCommand(v)
+	if m.Key != "test" || m.Revision != "redacted" || m.GOVersion != "redacted" ||
+		m.GOOS != runtime.GOOS || m.GOARCH != runtime.GOARCH || m.Version != (Version{Major: 1}) {
+		t.Errorf("unexpected parsed meta: %+v", m)
+	}
+
+	buf := &bytes.Buffer{}
+	h.writeMeta(buf)
+	if !strings.HasPrefix(buf.String(), v+"\n") {
+		t.Errorf("OutputMeta is not redacted: %s", buf.String())
+	}
+}
+
+func TestFormatMetricEmitBoth(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	now := time.Unix(1700000060, 0)
+	values := PluginValues{Values: map[string]interface{}{"requests": 160.0}, Timestamp: now}
+	last := PluginValues{Values: map[string]interface{}{"requests": 100.0}, Timestamp: now.Add(-time.Minute)}
+	buf := &bytes.Buffer{}
+	for _, line := range h.formatMetric("http", Metrics{Name: "requests", EmitBoth: true}, values, last) {
+		h.printLine(buf, line)
+	}
+	want := "test.http.requests\t160.000000\t1700000060\ntest.http.requests.rate\t60.000000\t1700000060\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
+
+type testHooksPlugin struct {
+	testMetricsPlugin
+	calls   *[]string
+	postErr *error
+}
+
+func (p testHooksPlugin) PreCollect() error {
+	*p.calls = append(*p.calls, "pre")
+	return nil
+}
+
+func (p testHooksPlugin) PostCollect(err error) {
+	*p.calls = append(*p.calls, "post")
+	*p.postErr = err
+}
+
+func TestCollectHooks(t *testing.T) {
+	collectErr := errors.New("connection refused")
+	var calls []string
+	var postErr error
+	p := testHooksPlugin{
+		testMetricsPlugin: testMetricsPlugin{key: "test", err: collectErr},
+		calls:             &calls,
+		postErr:           &postErr,
+	}
+	h := NewIdpcPlugin(p)
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+
+	err := h.writeMetricsValues(io.Discard, p)
+	if !errors.Is(err, collectErr) {
+		t.Fatalf("expected %v, got %v", collectErr, err)
+	}
+	if strings.Join(calls, ",") != "pre,post" {
+		t.Errorf("unexpected hook calls: %v", calls)
+	}
+	if !errors.Is(postErr, collectErr) {
+		t.Errorf("PostCollect should receive the collection error, got %v", postErr)
+	}
+}
+
+func TestStateFilePath(t *testing.T) {
+	dir := t.TempDir()
+	defer os.Unsetenv(PLUGIN_ENV_VAR)
+	os.Setenv(PLUGIN_ENV_VAR, dir)
+
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	path := h.StateFilePath()
+	if filepath.Dir(path) != dir || !strings.HasPrefix(filepath.Base(path), PLUGIN_PREFIX+"-test-metrics-") {
+		t.Errorf("unexpected state file path %s", path)
+	}
+	if err := h.SaveValues(PluginValues{Values: map[string]interface{}{"a": 1.0}, Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("SaveValues should write to StateFilePath: %v", err)
+	}
+}
+
+func TestMetadataThrottle(t *testing.T) {
+	p := testCombinedPlugin{testMetricsPlugin{key: "test"}}
+	for _, tc := range []struct {
+		throttle MetadataThrottle
+		second   string
+	}{
+		{MetadataSkip, ""},
+		{MetadataEmit, "{\"role\":\"primary\"}\n"},
+	} {
+		h := NewIdpcPlugin(p)
+		h.TempFile = filepath.Join(t.TempDir(), "state")
+		h.MetadataThrottle = tc.throttle
+		// the second run emits identical metadata
+		h.MetadataForceEmit = true
+		for i, want := range []string{"{\"role\":\"primary\"}\n", tc.second} {
+			out := &bytes.Buffer{}
+			if err := h.writeMetadataValues(out, p); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != want {
+				t.Errorf("throttle %d, run %d: got %q, want %q", tc.throttle, i+1, out.String(), want)
+			}
+		}
+	}
+}
+
+func TestMetadataUnchanged(t *testing.T) {
+	p := testCombinedPlugin{testMetricsPlugin{key: "test"}}
+	for _, force := range []bool{false, true} {
+		store := &countingStore{}
+		now := time.Unix(1700000000, 0)
+		h := NewIdpcPlugin(p)
+		h.Store = store
+		h.Clock = func() time.Time { return now }
+		h.MetadataForceEmit = force
+
+		second := ""
+		if force {
+			second = "{\"role\":\"primary\"}\n"
+		}
+		for i, want := range []string{"{\"role\":\"primary\"}\n", second} {
+			out := &bytes.Buffer{}
+			if err := h.writeMetadataValues(out, p); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != want {
+				t.Errorf("force %v, run %d: got %q, want %q", force, i+1, out.String(), want)
+			}
+			now = now.Add(time.Hour)
+		}
+		if store.saves != 1 {
+			t.Errorf("force %v: saved %d times, want 1", force, store.saves)
+		}
+	}
+}
+
+type countingStore struct {
+	MemoryStore
+	saves int
+}
+
+func (s *countingStore) Save(values PluginValues) error {
+	s.saves++
+	return s.MemoryStore.Save(values)
+}
+
+// failingStore fails every Save.
+type failingStore struct {
+	MemoryStore
+}
+
+func (s *failingStore) Save(values PluginValues) error {
+	return errors.New("disk full")
+}
+
+type testEmptyMetadataPlugin struct {
+	testMetricsPlugin
+	metadata map[string]interface{}
+}
+
+func (p testEmptyMetadataPlugin) Metadata() (map[string]interface{}, error) {
+	return p.metadata, nil
+}
+
+func TestMetadataFirstRun(t *testing.T) {
+	for _, tc := range []struct {
+		metadata map[string]interface{}
+		want     string
+	}{
+		{nil, "null\n"},
+		{map[string]interface{}{}, "{}\n"},
+	} {
+		p := testEmptyMetadataPlugin{testMetricsPlugin{key: "test"}, tc.metadata}
+		h := NewIdpcPlugin(p)
+		h.Store = &MemoryStore{}
+		advance := testClock(&h)
+		for i, want := range []string{tc.want, ""} {
+			out := &bytes.Buffer{}
+			if err := h.writeMetadataValues(out, p); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != want {
+				t.Errorf("%v, run %d: got %q, want %q", tc.metadata, i+1, out.String(), want)
+			}
+			advance(time.Hour)
+		}
+	}
+
+	p := testCombinedPlugin{testMetricsPlugin{key: "test"}}
+	h := NewIdpcPlugin(p)
+	h.Store = &failingStore{}
+	if err := h.writeMetadataValues(io.Discard, p); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("expected the save error, got %v", err)
+	}
+}
+
+type testIntMetadataPlugin struct {
+	testMetricsPlugin
+}
+
+func (p testIntMetadataPlugin) Metadata() (map[string]interface{}, error) {
+	return map[string]interface{}{"cores": 5, "disks": []interface{}{int64(1), uint8(2)}}, nil
+}
+
+func TestMetadataNumericTypes(t *testing.T) {
+	p := testIntMetadataPlugin{testMetricsPlugin{key: "test"}}
+	store := &countingStore{}
+	last := time.Unix(1700000000, 0)
+	// the cached metadata as decoded from the JSON state file
+	store.MemoryStore.Save(PluginValues{
+		Values:    map[string]interface{}{"cores": float64(5), "disks": []interface{}{float64(1), float64(2)}, "_lastTime": float64(last.Unix())},
+		Timestamp: last,
+	})
+	h := NewIdpcPlugin(p)
+	h.Store = store
+	h.Clock = func() time.Time { return last.Add(time.Hour) }
+	if err := h.writeMetadataValues(io.Discard, p); err != nil {
+		t.Fatal(err)
+	}
+	if store.saves != 0 {
+		t.Errorf("unchanged metadata was saved %d times", store.saves)
+	}
+
+	if equalMetadata(map[string]interface{}{"cores": 5}, map[string]interface{}{"cores": 6.0}) {
+		t.Error("different values compared equal")
+	}
+}
+
+func TestSummary(t *testing.T) {
+	p := testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"": {Metrics: []Metrics{{Name: "a"}, {Name: "b"}, {Name: "missing"}}}},
+		values: map[string]interface{}{"a": 1.0, "b": 2.0},
+		delay:  20 * time.Millisecond,
+	}
+	h := NewIdpcPlugin(p)
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	h.Summary = true
+
+	stderr := os.Stderr
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stderr = w
+	err = h.writeMetricsValues(io.Discard, p)
+	os.Stderr = stderr
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := io.ReadAll(r)
+
+	var n, ms int
+	if _, err := fmt.Sscanf(string(out), "# emitted %d metrics in %dms\n", &n, &ms); err != nil {
+		t.Fatalf("unexpected summary %q: %v", out, err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 emitted metrics, got %d", n)
+	}
+	if ms < 20 || ms > 10000 {
+		t.Errorf("implausible duration %dms", ms)
+	}
+}
+
+func TestCheckPluginVersion(t *testing.T) {
+	bin := buildTestPlugin(t, "testdata/version-plugin.go")
+	defer os.Unsetenv("VERSION_ARG")
+	for _, arg := range []string{"version", "-v", "--version"} {
+		os.Setenv("VERSION_ARG", arg)
+		meta, err := CheckPluginVersion(bin)
+		if err != nil {
+			t.Errorf("%s: %v", arg, err)
+			continue
+		}
+		if meta.Key != "test" || meta.Version != (Version{Major: 1, Minor: 2, Patch: 3}) {
+			t.Errorf("%s: unexpected meta %+v", arg, meta)
+		}
+	}
+
+	os.Setenv("VERSION_ARG", "-version")
+	if _, err := CheckPluginVersion(bin); err == nil {
+		t.Error("expected an error when no style matches")
+	}
+}
+
+func TestRatioIsFraction(t *testing.T) {
+	p := testMetricsPlugin{
+		key: "test",
+		graphs: map[string]Graphs{
+			"percent": {Unit: UnitPercentage, Metrics: []Metrics{{Name: "hit_ratio", RatioIsFraction: true}}},
+			"float":   {Unit: UnitFloat, Metrics: []Metrics{{Name: "load", RatioIsFraction: true}}},
+		},
+		values: map[string]interface{}{"hit_ratio": 0.85, "load": 0.5},
+	}
+	h := NewIdpcPlugin(p)
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	out := &bytes.Buffer{}
+	if err := h.writeMetricsValues(out, p); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "test.percent.hit_ratio\t85.000000\t") {
+		t.Errorf("expected the ratio as a percentage: %q", out.String())
+	}
+	if !strings.Contains(out.String(), "test.float.load\t0.500000\t") {
+		t.Errorf("RatioIsFraction should only apply to percentage graphs: %q", out.String())
+	}
+}
+
+func TestResetPolicy(t *testing.T) {
+	now := time.Unix(1700000060, 0)
+	dropped := math.NaN()
+	for _, sc := range []struct {
+		name        string
+		last, value map[string]interface{}
+		want        map[ResetPolicy][3]float64 // uint32, uint64, float
+	}{
+		{
+			name:  "plausible wrap",
+			last:  map[string]interface{}{"uint32": uint32(math.MaxUint32 - 5), "uint64": uint64(math.MaxUint64 - 5), "float": float64(math.MaxUint32 - 5)},
+			value: map[string]interface{}{"uint32": uint32(10), "uint64": uint64(10), "float": 10.0},
+			want: map[ResetPolicy][3]float64{
+				ResetWrapPlausible: {16, 16, dropped},
+				ResetStrict:        {dropped, dropped, dropped},
+				ResetWrap:          {16, 16, dropped},
+				ResetZero:          {0, 0, 0},
+				ResetAllowDecrease: {10 - float64(math.MaxUint32-5), 10 - float64(uint64(math.MaxUint64-5)), 10 - float64(math.MaxUint32-5)},
+			},
+		},
+		{
+			name:  "genuine reset",
+			last:  map[string]interface{}{"uint32": uint32(1000), "uint64": uint64(1000), "float": 1000.0},
+			value: map[string]interface{}{"uint32": uint32(10), "uint64": uint64(10), "float": 10.0},
+			want: map[ResetPolicy][3]float64{
+				ResetWrapPlausible: {dropped, dropped, dropped},
+				ResetStrict:        {dropped, dropped, dropped},
+				ResetWrap:          {math.MaxUint32 - 989, float64(uint64(math.MaxUint64 - 989)), dropped},
+				ResetZero:          {0, 0, 0},
+				ResetAllowDecrease: {-990, -990, -990},
+			},
+		},
+	} {
+		for policy, want := range sc.want {
+			h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+			h.ResetPolicy = policy
+			for i, metric := range []Metrics{
+				{Name: "uint32", Diff: true, Type: metricTypeUint32},
+				{Name: "uint64", Diff: true, Type: metricTypeUint64},
+				{Name: "float", Diff: true},
+			} {
+				values := PluginValues{Values: copyValues(PluginValues{Values: sc.value}).Values, Timestamp: now}
+				last := PluginValues{Values: sc.last, Timestamp: now.Add(-time.Minute)}
+				line, ok := h.formatValues("", metric, values, last)
+				if math.IsNaN(want[i]) {
+					if ok {
+						t.Errorf("%s, policy %d: %s should be dropped, got %v", sc.name, policy, metric.Name, line.Value)
+					}
+				} else if !ok || line.Value != want[i] {
+					t.Errorf("%s, policy %d: %s = %v (%v), want %v", sc.name, policy, metric.Name, line.Value, ok, want[i])
+				}
+				_, reset := values.Values[lastResetPrefix+metric.Name]
+				if wantReset := math.IsNaN(want[i]) || policy == ResetZero; reset != wantReset {
+					t.Errorf("%s, policy %d: %s reset recorded = %v, want %v", sc.name, policy, metric.Name, reset, wantReset)
+				}
+			}
+		}
+	}
+
+	// the deprecated AllowDecrease maps to ResetAllowDecrease
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	h.ResetPolicy = ResetStrict
+	if got := h.resetPolicy(Metrics{AllowDecrease: true}); got != ResetAllowDecrease {
+		t.Errorf("AllowDecrease policy = %d, want %d", got, ResetAllowDecrease)
+	}
+	if got := h.resetPolicy(Metrics{}); got != ResetStrict {
+		t.Errorf("policy = %d, want %d", got, ResetStrict)
+	}
+}
+
+func TestDecimalSeparator(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	now := time.Unix(1700000000, 0)
+	buf := &bytes.Buffer{}
+	h.printValue(buf, "test.ratio", 0.85, now)
+	h.DecimalSeparator = ","
+	h.printValue(buf, "test.ratio", 0.85, now)
+	h.printValue(buf, "test.count", uint64(1000), now)
+	want := "test.ratio\t0.850000\t1700000000\ntest.ratio\t0,850000\t1700000000\ntest.count\t1000\t1700000000\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
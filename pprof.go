@@ -0,0 +1,28 @@
+//go:build pprof
+// +build pprof
+
+package plugin
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// servePprof 在addr上启动 /debug/pprof/ 服务，返回关闭服务的函数。
+// net/http/pprof 在init中向 http.DefaultServeMux 注册处理函数，因此本文件只在使用 -tags pprof 构建时编译
+func servePprof(addr string) (stop func(), err error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	return func() { srv.Close() }, nil
+}
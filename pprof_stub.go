@@ -0,0 +1,13 @@
+//go:build !pprof
+// +build !pprof
+
+package plugin
+
+import "errors"
+
+// errPprofDisabled 没有使用 -tags pprof 构建时设置了 PprofAddr
+var errPprofDisabled = errors.New("pprof is not available, build with -tags pprof")
+
+func servePprof(addr string) (stop func(), err error) {
+	return nil, errPprofDisabled
+}
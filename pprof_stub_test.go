@@ -0,0 +1,27 @@
+//go:build !pprof
+// +build !pprof
+
+package plugin
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestNoDefaultPprof(t *testing.T) {
+	req, err := http.NewRequest("GET", "/debug/pprof/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, pattern := http.DefaultServeMux.Handler(req); pattern != "" {
+		t.Errorf("http.DefaultServeMux has a pprof route %q", pattern)
+	}
+
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	h.PprofAddr = freeAddr(t)
+	if err := h.ServeHTTP(freeAddr(t)); err != errPprofDisabled {
+		t.Errorf("ServeHTTP error = %v, want %v", err, errPprofDisabled)
+	}
+}
@@ -0,0 +1,47 @@
+//go:build pprof
+// +build pprof
+
+package plugin
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServeHTTPPprof(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	h.PprofAddr = freeAddr(t)
+	go h.ServeHTTP(freeAddr(t))
+
+	var res *http.Response
+	var err error
+	for i := 0; i < 50; i++ {
+		res, err = http.Get("http://" + h.PprofAddr + "/debug/pprof/cmdline")
+		if err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("pprof endpoint not reachable: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("pprof status = %d", res.StatusCode)
+	}
+}
+
+func TestServePprofStop(t *testing.T) {
+	addr := freeAddr(t)
+	stop, err := servePprof(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	if _, err := http.Get("http://" + addr + "/debug/pprof/"); err == nil {
+		t.Error("pprof server should be closed after stop")
+	}
+}
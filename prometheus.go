@@ -0,0 +1,247 @@
+package plugin
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParsePrometheus 解析Prometheus文本格式的指标，返回可以作为 Metrics 返回值的map。
+// 标签按名称排序后以 name.label.value 的形式追加到指标名称中，
+// 标签值中的 "." 和空白替换为 "_"，例如 http_requests_total{method="get",code="200"}
+// 转换为 http_requests_total.code.200.method.get。注释行和时间戳被忽略
+func ParsePrometheus(r io.Reader) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, err := parsePrometheusLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		values[name] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// parsePrometheusLine 解析一行样本，返回展开标签后的名称和值
+func parsePrometheusLine(line string) (string, float64, error) {
+	end := strings.IndexAny(line, "{ \t")
+	if end <= 0 {
+		return "", 0, fmt.Errorf("invalid sample %q", line)
+	}
+	name, rest := line[:end], line[end:]
+	if rest[0] == '{' {
+		labels, n, err := parsePrometheusLabels(rest[1:])
+		if err != nil {
+			return "", 0, err
+		}
+		rest = rest[n+1:]
+		name = flattenLabels(name, labels)
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return "", 0, fmt.Errorf("invalid sample %q", line)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return "", 0, err
+	}
+	return name, value, nil
+}
+
+// parsePrometheusLabels 解析 "{" 之后的标签，返回标签和包括 "}" 在内消耗的字节数
+func parsePrometheusLabels(s string) (map[string]string, int, error) {
+	labels := make(map[string]string)
+	i := 0
+	for {
+		for i < len(s) && (s[i] == ' ' || s[i] == ',') {
+			i++
+		}
+		if i < len(s) && s[i] == '}' {
+			return labels, i + 1, nil
+		}
+		eq := strings.IndexByte(s[i:], '=')
+		if eq < 0 || i+eq+1 >= len(s) || s[i+eq+1] != '"' {
+			return nil, 0, fmt.Errorf("invalid labels %q", s)
+		}
+		key := strings.TrimSpace(s[i : i+eq])
+		i += eq + 2
+		var value strings.Builder
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				if s[i] == 'n' {
+					value.WriteByte('\n')
+					continue
+				}
+			}
+			value.WriteByte(s[i])
+		}
+		if i >= len(s) {
+			return nil, 0, fmt.Errorf("unterminated label value in %q", s)
+		}
+		i++
+		labels[key] = value.String()
+	}
+}
+
+// flattenLabels 将标签按名称排序后追加到name中
+func flattenLabels(name string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	r := strings.NewReplacer(".", "_", " ", "_", "\t", "_", "\n", "_")
+	for _, k := range keys {
+		name += "." + k + "." + r.Replace(labels[k])
+	}
+	return name
+}
+
+// FormatPrometheus 以Prometheus文本格式输出指标值，见 IdpcPlugin.Format
+const FormatPrometheus = "prometheus"
+
+// OutputPrometheus 采集指标并以Prometheus文本格式输出，可以作为node_exporter textfile collector的输入。
+// 指标名称中的 "." 等非法字符替换为 "_"。Diff指标的值是会减少的速率，类型为gauge，
+// 只有 Metrics.EmitBoth 输出的原始累计值类型为counter，
+// HELP为指标的Label(与图表Label不同时)或图表的Label和单位。
+// 构建信息(见 BuildInfo)和 ConstMetrics 以gauge输出，Label作为Prometheus标签。
+// 设置了 PrometheusTimestamps 时每个样本附带毫秒时间戳
+func (h *IdpcPlugin) OutputPrometheus(w io.Writer) error {
+	mp, ok := h.Plugin.(MetricsPlugin)
+	if !ok {
+		return errNotMetricsPlugin
+	}
+	groups, now, err := h.collectValues(mp)
+	if err != nil && !isSkip(err) {
+		return err
+	}
+	if err != nil {
+		h.logger().Debug().Err(err).Msg("OutputPrometheus: ")
+	}
+
+	bw := bufio.NewWriter(w)
+	seen := make(map[string]bool)
+	for _, g := range groups {
+		label := g.graph.Label
+		if label == "" {
+			label = title(h.graphName(g.key))
+		}
+		// 回填的旧值与本次的值同名，Prometheus格式中不能重复，只输出本次的值
+		for _, line := range g.lines {
+			if !h.validValue(line.Name, line.Value) {
+				continue
+			}
+			name := prometheusName(line.Name)
+			if !seen[name] {
+				seen[name] = true
+				help := label
+				if line.help != "" && line.help != label {
+					help = line.help
+				}
+				if g.graph.Unit != "" {
+					help += " (" + g.graph.Unit + ")"
+				}
+				typ := "gauge"
+				if line.counter {
+					typ = "counter"
+				}
+				fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, prometheusHelpReplacer.Replace(help), name, typ)
+			}
+			h.writePrometheusSample(bw, name, line)
+		}
+	}
+	for _, line := range h.infoLines(now) {
+		if !h.validValue(line.Name, line.Value) {
+			continue
+		}
+		name := prometheusName(line.Name)
+		if !seen[name] {
+			seen[name] = true
+			if line.help != "" {
+				fmt.Fprintf(bw, "# HELP %s %s\n", name, prometheusHelpReplacer.Replace(line.help))
+			}
+			fmt.Fprintf(bw, "# TYPE %s gauge\n", name)
+		}
+		h.writePrometheusSample(bw, name+prometheusLabels(line.labels), line)
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	h.feedSink(groups)
+	return nil
+}
+
+// writePrometheusSample 输出一个样本，name可以包含标签
+func (h *IdpcPlugin) writePrometheusSample(w io.Writer, name string, line MetricLine) {
+	fmt.Fprintf(w, "%s %s", name, prometheusValue(line.Value))
+	if h.PrometheusTimestamps {
+		fmt.Fprintf(w, " %d", line.Time.UnixNano()/int64(time.Millisecond))
+	}
+	io.WriteString(w, "\n")
+}
+
+var (
+	prometheusHelpReplacer       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	prometheusLabelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// prometheusLabels 返回 {name="value",...} 格式的标签，没有标签时返回空字符串
+func prometheusLabels(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("{")
+	for i, l := range labels {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(prometheusName(l.Name))
+		b.WriteString(`="`)
+		b.WriteString(prometheusLabelValueReplacer.Replace(l.Value))
+		b.WriteString(`"`)
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+// prometheusName 将指标名称转换为合法的Prometheus指标名称 [a-zA-Z_:][a-zA-Z0-9_:]*
+func prometheusName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func prometheusValue(value interface{}) string {
+	switch v := value.(type) {
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,154 @@
+package plugin
+
+import (
+	"bytes"
+	"math"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePrometheus(t *testing.T) {
+	exposition := `# HELP http_requests_total The total number of HTTP requests.
+# TYPE http_requests_total counter
+http_requests_total{method="post",code="200"} 1027 1395066363000
+http_requests_total{method="post",code="400"}    3 1395066363000
+
+# a histogram
+http_request_duration_seconds_bucket{le="0.05"} 24054
+http_request_duration_seconds_bucket{le="+Inf"} 144320
+http_request_duration_seconds_sum 53423
+msdos_file_access_time_seconds{path="C:\\DIR\\FILE.TXT",error="Cannot find file:\n\"FILE.TXT\""} 1.458255915e9
+go_gc_pause{} NaN
+`
+	values, err := ParsePrometheus(strings.NewReader(exposition))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]float64{
+		"http_requests_total.code.200.method.post":                                               1027,
+		"http_requests_total.code.400.method.post":                                               3,
+		"http_request_duration_seconds_bucket.le.0_05":                                           24054,
+		"http_request_duration_seconds_bucket.le.+Inf":                                           144320,
+		"http_request_duration_seconds_sum":                                                      53423,
+		`msdos_file_access_time_seconds.error.Cannot_find_file:_"FILE_TXT".path.C:\DIR\FILE_TXT`: 1.458255915e9,
+	} {
+		if values[name] != want {
+			t.Errorf("%s: got %v, want %v", name, values[name], want)
+		}
+	}
+	if v, ok := values["go_gc_pause"].(float64); !ok || !math.IsNaN(v) {
+		t.Errorf("go_gc_pause: got %v", values["go_gc_pause"])
+	}
+	if len(values) != 7 {
+		t.Errorf("unexpected values %v", values)
+	}
+
+	for _, bad := range []string{"no_value\n", `bad{label="x} 1` + "\n", "bad 1 2 3\n", "bad abc\n"} {
+		if _, err := ParsePrometheus(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestPrometheusName(t *testing.T) {
+	for name, want := range map[string]string{
+		"redis.memory.used":     "redis_memory_used",
+		"disk.sda-1.read_bytes": "disk_sda_1_read_bytes",
+		"1st.value":             "_st_value",
+		"ns:metric.total":       "ns:metric_total",
+		"cpu.0.user%":           "cpu_0_user_",
+	} {
+		if got := prometheusName(name); got != want {
+			t.Errorf("prometheusName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestOutputPrometheus(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{
+		key: "redis",
+		graphs: map[string]Graphs{
+			"memory": {Label: "Memory", Unit: UnitBytes, Metrics: []Metrics{
+				{Name: "used", Label: "Used memory"},
+				{Name: "peak", Label: "Memory"},
+				{Name: "evicted", Label: "Evicted", Diff: true},
+				{Name: "hits", Label: "Hits", EmitBoth: true},
+				{Name: "bad", Scale: 10},
+			}},
+		},
+		values: map[string]interface{}{"used": 1024.0, "peak": uint64(2048), "evicted": 100.0, "hits": 10.0, "bad": math.MaxFloat64},
+	})
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	testClock(&h)
+	last := PluginValues{Values: map[string]interface{}{"evicted": 100.0, "hits": 4.0}, Timestamp: h.now().Add(-time.Minute)}
+	if err := h.SaveValues(last); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := h.OutputPrometheus(buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP redis_memory_used Used memory (bytes)
+# TYPE redis_memory_used gauge
+redis_memory_used 1024
+# HELP redis_memory_peak Memory (bytes)
+# TYPE redis_memory_peak gauge
+redis_memory_peak 2048
+# HELP redis_memory_evicted Evicted (bytes)
+# TYPE redis_memory_evicted gauge
+redis_memory_evicted 0
+# HELP redis_memory_hits Hits (bytes)
+# TYPE redis_memory_hits counter
+redis_memory_hits 10
+# HELP redis_memory_hits_rate Hits (bytes)
+# TYPE redis_memory_hits_rate gauge
+redis_memory_hits_rate 6
+`
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	// a fresh state file, the previous one was just updated
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	h.PrometheusTimestamps = true
+	buf.Reset()
+	if err := h.OutputPrometheus(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`(?m)^redis_memory_used 1024 \d{13}$`).MatchString(buf.String()) {
+		t.Errorf("expected millisecond timestamps, got:\n%s", buf.String())
+	}
+}
+
+func TestOutputPrometheusInfo(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test", values: map[string]interface{}{}})
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	h.BuildInfo = true
+	h.ConstMetrics = []ConstMetric{
+		{Name: "config", Value: 1, Labels: []Label{{Name: "mode", Value: `a "b"`}}},
+		{Name: "config", Value: 1, Labels: []Label{{Name: "mode", Value: "c"}}},
+		{Name: "shards", Value: 4},
+	}
+	buf := &bytes.Buffer{}
+	if err := h.OutputPrometheus(buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_plugin_build_info Plugin build information
+# TYPE test_plugin_build_info gauge
+test_plugin_build_info{version="1.0.0",revision="test",go_version="` + runtime.Version() +
+		`",goos="` + runtime.GOOS + `",goarch="` + runtime.GOARCH + `"} 1
+# TYPE test_config gauge
+test_config{mode="a \"b\""} 1
+test_config{mode="c"} 1
+# TYPE test_shards gauge
+test_shards 4
+`
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
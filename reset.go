@@ -0,0 +1,68 @@
+package plugin
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// lastResetPrefix 状态中记录指标最近一次计数器重置时间(Unix秒)的键前缀
+const lastResetPrefix = ".last_reset."
+
+// carryResets 将上次状态中的重置时间复制到本次状态中
+func carryResets(last, current PluginValues) {
+	for k, v := range last.Values {
+		if strings.HasPrefix(k, lastResetPrefix) {
+			current.Values[k] = v
+		}
+	}
+}
+
+// lastResets 返回状态中记录的每个指标最近一次重置的时间
+func lastResets(values PluginValues) map[string]time.Time {
+	resets := make(map[string]time.Time)
+	for k, v := range values.Values {
+		if !strings.HasPrefix(k, lastResetPrefix) {
+			continue
+		}
+		var sec int64
+		switch v := v.(type) {
+		case int64:
+			// 本次运行中检测到的重置
+			sec = v
+		case float64:
+			// 从状态文件中加载
+			sec = int64(v)
+		}
+		resets[strings.TrimPrefix(k, lastResetPrefix)] = time.Unix(sec, 0)
+	}
+	return resets
+}
+
+// LastResets 返回最近一次运行后每个指标最近一次检测到计数器重置的时间
+func (h *IdpcPlugin) LastResets() map[string]time.Time {
+	resets := make(map[string]time.Time, len(h.resets))
+	for name, t := range h.resets {
+		resets[name] = t
+	}
+	return resets
+}
+
+// printResets 为每个重置过的指标输出 key.plugin.seconds_since_reset 指标
+func (h *IdpcPlugin) printResets(w io.Writer, now time.Time) {
+	names := make([]string, 0, len(h.resets))
+	for name := range h.resets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	key := h.metricName(h.Plugin.Meta().Key + ".plugin.seconds_since_reset")
+	for _, name := range names {
+		labels := []Label{{Name: "metric", Value: name}}
+		elapsed := now.Sub(h.resets[name])
+		if elapsed < 0 {
+			elapsed = 0
+		}
+		h.printValue(w, labeledName(key, labels), uint64(elapsed/time.Second), now)
+	}
+}
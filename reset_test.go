@@ -0,0 +1,62 @@
+package plugin
+
+import (
+	"bytes"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestSecondsSinceReset(t *testing.T) {
+	p := testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"": {Metrics: []Metrics{{Name: "counter", Diff: true}}}},
+		values: map[string]interface{}{"counter": 100.0},
+	}
+	h := NewIdpcPlugin(p)
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	h.EmitResets = true
+	advance := testClock(&h)
+	buf := &bytes.Buffer{}
+	if err := h.writeMetricsValues(buf, p); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.LastResets()) != 0 {
+		t.Fatalf("unexpected reset: %v", h.LastResets())
+	}
+
+	// the counter goes down: a reset
+	advance(time.Minute)
+	p.values["counter"] = 10.0
+	if err := h.writeMetricsValues(buf, p); err != nil {
+		t.Fatal(err)
+	}
+	last, err := h.LoadLastValues()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resetAt, ok := last.Values[lastResetPrefix+"counter"]
+	if !ok {
+		t.Fatalf("reset time is not saved: %v", last.Values)
+	}
+
+	// the next run reports the time since the reset
+	advance(2 * time.Minute)
+	p.values["counter"] = 70.0
+	buf.Reset()
+	if err := h.writeMetricsValues(buf, p); err != nil {
+		t.Fatal(err)
+	}
+	if !h.LastResets()["counter"].Equal(time.Unix(int64(resetAt.(float64)), 0)) {
+		t.Errorf("LastResets = %v, want %v", h.LastResets(), resetAt)
+	}
+	re := regexp.MustCompile(`(?m)^test\.plugin\.seconds_since_reset;metric=counter\t(\d+)\t\d+$`)
+	m := re.FindStringSubmatch(buf.String())
+	if m == nil {
+		t.Fatalf("seconds_since_reset not emitted: %q", buf.String())
+	}
+	if m[1] != "120" {
+		t.Errorf("seconds_since_reset = %s", m[1])
+	}
+}
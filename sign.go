@@ -0,0 +1,144 @@
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PLUGIN_SIGN_KEY_ENV_VAR 输出签名密钥的环境变量，见 IdpcPlugin.SignKey
+var PLUGIN_SIGN_KEY_ENV_VAR = strings.ReplaceAll(strings.ToUpper(PLUGIN_PREFIX), "-", "_") + "_SIGN_KEY"
+
+// PLUGIN_SIGN_KEY_FILE_ENV_VAR 保存输出签名密钥的文件路径的环境变量
+var PLUGIN_SIGN_KEY_FILE_ENV_VAR = PLUGIN_SIGN_KEY_ENV_VAR + "_FILE"
+
+// signaturePrefix 签名行的前缀，之后为十六进制的HMAC-SHA256
+const signaturePrefix = "# signature hmac-sha256 "
+
+var (
+	// ErrNoSignature 输出中没有签名行
+	ErrNoSignature = errors.New("output is not signed")
+	// ErrBadSignature 签名与输出内容不匹配
+	ErrBadSignature = errors.New("output signature mismatch")
+)
+
+// signKey 返回输出签名的密钥，依次使用 SignKey、PLUGIN_SIGN_KEY_ENV_VAR 和
+// PLUGIN_SIGN_KEY_FILE_ENV_VAR 指定的文件，都没有设置时返回nil
+func (h *IdpcPlugin) signKey() ([]byte, error) {
+	if h.SignKey != nil {
+		return h.SignKey, nil
+	}
+	if key := os.Getenv(PLUGIN_SIGN_KEY_ENV_VAR); key != "" {
+		return []byte(key), nil
+	}
+	if path := os.Getenv(PLUGIN_SIGN_KEY_FILE_ENV_VAR); path != "" {
+		key, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read sign key: %w", err)
+		}
+		return bytes.TrimSpace(key), nil
+	}
+	return nil, nil
+}
+
+// writeSigned 将data和对data的签名行写入w
+func writeSigned(w io.Writer, data, key []byte) error {
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, signaturePrefix+hex.EncodeToString(signature(data, key))+"\n")
+	return err
+}
+
+func signature(data, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// VerifySignedOutput 校验带签名的制表符分隔格式输出，返回其中的指标值。
+// 输出由一个或多个块组成，每个块是一次运行的输出及其后对这些内容(不包括之前的块)的签名行，
+// 例如 OutputFile 每次运行向文件追加一个块。每个块单独校验，最后一个签名行之后不能有未签名的内容。
+// 注释行被忽略；整数值解析为uint64或int64，其他值解析为float64
+func VerifySignedOutput(r io.Reader, key []byte) ([]MetricLine, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var lines []MetricLine
+	// start 当前块的开始位置
+	start, signed := 0, false
+	for pos := 0; pos < len(data); {
+		end, next := len(data), len(data)
+		if i := bytes.IndexByte(data[pos:], '\n'); i >= 0 {
+			end, next = pos+i, pos+i+1
+		}
+		if line := data[pos:end]; bytes.HasPrefix(line, []byte(signaturePrefix)) {
+			sig, err := hex.DecodeString(string(line[len(signaturePrefix):]))
+			if err != nil || !hmac.Equal(sig, signature(data[start:pos], key)) {
+				return nil, ErrBadSignature
+			}
+			block, err := parseMetricLines(data[start:pos])
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, block...)
+			start, signed = next, true
+		}
+		pos = next
+	}
+	if !signed || len(bytes.TrimSpace(data[start:])) > 0 {
+		return nil, ErrNoSignature
+	}
+	return lines, nil
+}
+
+// parseMetricLines 解析制表符分隔格式的输出，忽略空行和注释行
+func parseMetricLines(data []byte) ([]MetricLine, error) {
+	var lines []MetricLine
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		text := scanner.Text()
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		line, err := parseMetricLine(text)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// parseMetricLine 解析 "name\tvalue\ttimestamp" 格式的一行
+func parseMetricLine(text string) (MetricLine, error) {
+	fields := strings.Split(text, "\t")
+	if len(fields) != 3 {
+		return MetricLine{}, fmt.Errorf("invalid metric line %q", text)
+	}
+	sec, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return MetricLine{}, fmt.Errorf("invalid timestamp in %q", text)
+	}
+	line := MetricLine{Name: fields[0], Time: time.Unix(sec, 0)}
+	if v, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+		line.Value = v
+	} else if v, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+		line.Value = v
+	} else if v, err := strconv.ParseFloat(fields[1], 64); err == nil {
+		line.Value = v
+	} else {
+		return MetricLine{}, fmt.Errorf("invalid value in %q", text)
+	}
+	return line, nil
+}
@@ -0,0 +1,125 @@
+package plugin
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedOutput(t *testing.T) {
+	p := testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"": {Metrics: []Metrics{{Name: "count", Type: metricTypeUint64}, {Name: "ratio"}}}},
+		values: map[string]interface{}{"count": uint64(42), "ratio": 0.5},
+	}
+	h := NewIdpcPlugin(p)
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	h.GraphComments = true
+	h.SignKey = []byte("secret")
+	out := &bytes.Buffer{}
+	if err := h.writeMetricsValues(out, p); err != nil {
+		t.Fatal(err)
+	}
+
+	lines, err := VerifySignedOutput(bytes.NewReader(out.Bytes()), []byte("secret"))
+	if err != nil {
+		t.Fatalf("%v: %q", err, out.String())
+	}
+	if len(lines) != 2 {
+		t.Fatalf("unexpected lines %+v", lines)
+	}
+	for _, line := range lines {
+		switch line.Name {
+		case "test.count":
+			if line.Value != uint64(42) {
+				t.Errorf("count = %v", line.Value)
+			}
+		case "test.ratio":
+			if line.Value != 0.5 {
+				t.Errorf("ratio = %v", line.Value)
+			}
+		default:
+			t.Errorf("unexpected line %+v", line)
+		}
+	}
+
+	if _, err := VerifySignedOutput(bytes.NewReader(out.Bytes()), []byte("other")); err != ErrBadSignature {
+		t.Errorf("wrong key: expected %v, got %v", ErrBadSignature, err)
+	}
+	tampered := strings.Replace(out.String(), "\t42\t", "\t43\t", 1)
+	if _, err := VerifySignedOutput(strings.NewReader(tampered), []byte("secret")); err != ErrBadSignature {
+		t.Errorf("tampered output: expected %v, got %v", ErrBadSignature, err)
+	}
+	unsigned := out.String()[:strings.Index(out.String(), signaturePrefix)]
+	if _, err := VerifySignedOutput(strings.NewReader(unsigned), []byte("secret")); err != ErrNoSignature {
+		t.Errorf("unsigned output: expected %v, got %v", ErrNoSignature, err)
+	}
+}
+
+func TestSignedOutputFile(t *testing.T) {
+	p := testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"": {Metrics: []Metrics{{Name: "count", Type: metricTypeUint64}}}},
+		values: map[string]interface{}{"count": uint64(1)},
+	}
+	h := NewIdpcPlugin(p)
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	h.SignKey = []byte("secret")
+	advance := testClock(&h)
+	path := filepath.Join(t.TempDir(), "metrics.log")
+	for run := 1; run <= 3; run++ {
+		p.values["count"] = uint64(run)
+		if err := h.OutputFile(path, FileOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		advance(time.Minute)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines, err := VerifySignedOutput(bytes.NewReader(data), []byte("secret"))
+	if err != nil {
+		t.Fatalf("%v: %q", err, data)
+	}
+	if len(lines) != 3 {
+		t.Fatalf("expected a line from each run, got %+v", lines)
+	}
+	for i, line := range lines {
+		if line.Value != uint64(i+1) {
+			t.Errorf("run %d: count = %v", i+1, line.Value)
+		}
+	}
+
+	tampered := strings.Replace(string(data), "test.count\t2\t", "test.count\t5\t", 1)
+	if _, err := VerifySignedOutput(strings.NewReader(tampered), []byte("secret")); err != ErrBadSignature {
+		t.Errorf("tampered block: expected %v, got %v", ErrBadSignature, err)
+	}
+	appended := string(data) + "test.count\t4\t1700000180\n"
+	if _, err := VerifySignedOutput(strings.NewReader(appended), []byte("secret")); err != ErrNoSignature {
+		t.Errorf("unsigned trailing lines: expected %v, got %v", ErrNoSignature, err)
+	}
+}
+
+func TestSignKeyEnv(t *testing.T) {
+	defer os.Unsetenv(PLUGIN_SIGN_KEY_ENV_VAR)
+	defer os.Unsetenv(PLUGIN_SIGN_KEY_FILE_ENV_VAR)
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(PLUGIN_SIGN_KEY_FILE_ENV_VAR, path)
+	if key, err := h.signKey(); err != nil || string(key) != "from-file" {
+		t.Errorf("key file: got %q, %v", key, err)
+	}
+	os.Setenv(PLUGIN_SIGN_KEY_ENV_VAR, "from-env")
+	if key, err := h.signKey(); err != nil || string(key) != "from-env" {
+		t.Errorf("env var: got %q, %v", key, err)
+	}
+}
@@ -0,0 +1,72 @@
+package plugin
+
+import "sync"
+
+// MetricBuffer 在内存中保存最近若干次运行计算出的指标，用于嵌入到其他服务中时在进程内读取，
+// 设置到 IdpcPlugin.Sink 后每次成功的运行都会写入，可以被多个goroutine同时使用
+type MetricBuffer struct {
+	mu   sync.Mutex
+	runs [][]MetricLine
+	next int
+	full bool
+}
+
+// NewMetricBuffer 创建最多保存size次运行结果的环形缓冲区
+func NewMetricBuffer(size int) *MetricBuffer {
+	if size < 1 {
+		size = 1
+	}
+	return &MetricBuffer{runs: make([][]MetricLine, size)}
+}
+
+func (b *MetricBuffer) add(lines []MetricLine) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.runs[b.next] = lines
+	b.next = (b.next + 1) % len(b.runs)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// Latest 返回最近一次运行的指标，没有运行过时返回nil
+func (b *MetricBuffer) Latest() []MetricLine {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.next == 0 && !b.full {
+		return nil
+	}
+	latest := b.runs[(b.next+len(b.runs)-1)%len(b.runs)]
+	return append([]MetricLine(nil), latest...)
+}
+
+// Runs 返回缓冲区中所有运行的指标，按时间从旧到新排列
+func (b *MetricBuffer) Runs() [][]MetricLine {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var runs [][]MetricLine
+	if b.full {
+		runs = append(runs, b.runs[b.next:]...)
+	}
+	return append(runs, b.runs[:b.next]...)
+}
+
+// feedSink 将一次成功运行计算出的指标写入 Sink，groups为nil(跳过了本次运行)时不写入
+func (h *IdpcPlugin) feedSink(groups []graphValues) {
+	if h.Sink == nil || groups == nil {
+		return
+	}
+	var lines []MetricLine
+	for _, g := range groups {
+		lines = append(lines, g.lines...)
+	}
+	h.Sink.add(lines)
+}
+
+// LatestMetrics 返回 Sink 中最近一次运行的指标，未设置 Sink 时返回nil
+func (h *IdpcPlugin) LatestMetrics() []MetricLine {
+	if h.Sink == nil {
+		return nil
+	}
+	return h.Sink.Latest()
+}
@@ -0,0 +1,115 @@
+package plugin
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLatestMetrics(t *testing.T) {
+	p := testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"g": {Metrics: []Metrics{{Name: "a"}, {Name: "b"}}}},
+		values: map[string]interface{}{"a": 1.0, "b": 2.0},
+	}
+	h := NewIdpcPlugin(p)
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	advance := testClock(&h)
+	if h.LatestMetrics() != nil {
+		t.Fatal("LatestMetrics without a sink should be nil")
+	}
+	h.Sink = NewMetricBuffer(2)
+	if h.LatestMetrics() != nil {
+		t.Fatal("LatestMetrics before any run should be nil")
+	}
+
+	for run := 1; run <= 3; run++ {
+		p.values["a"] = float64(run)
+		if err := h.writeMetricsValues(io.Discard, p); err != nil {
+			t.Fatal(err)
+		}
+		lines := h.LatestMetrics()
+		if len(lines) != 2 {
+			t.Fatalf("run %d: unexpected lines %+v", run, lines)
+		}
+		for _, line := range lines {
+			if line.Name == "test.g.a" && line.Value != float64(run) {
+				t.Errorf("run %d: test.g.a = %v", run, line.Value)
+			}
+		}
+		advance(time.Minute)
+	}
+
+	runs := h.Sink.Runs()
+	if len(runs) != 2 {
+		t.Fatalf("ring buffer should keep 2 runs, got %d", len(runs))
+	}
+	for i, run := range runs {
+		for _, line := range run {
+			if line.Name == "test.g.a" && line.Value != float64(i+2) {
+				t.Errorf("runs[%d]: test.g.a = %v, want %d", i, line.Value, i+2)
+			}
+		}
+	}
+}
+
+// cancelStore cancels the run when the last values are loaded.
+type cancelStore struct {
+	MemoryStore
+	cancel func()
+}
+
+func (s *cancelStore) Load() (PluginValues, error) {
+	s.cancel()
+	return s.MemoryStore.Load()
+}
+
+func TestSinkFailedRuns(t *testing.T) {
+	p := testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"g": {Metrics: []Metrics{{Name: "a"}}}},
+		values: map[string]interface{}{"a": 1.0},
+	}
+	h := NewIdpcPlugin(p)
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	h.Sink = NewMetricBuffer(2)
+	advance := testClock(&h)
+
+	// cancel after the values were collected and computed, before they are saved
+	ctx, cancel := context.WithCancel(context.Background())
+	h.ctx = ctx
+	h.Store = &cancelStore{cancel: cancel}
+	if err := h.writeMetricsValues(io.Discard, p); err != context.Canceled {
+		t.Fatalf("a cancelled run should fail, got %v", err)
+	}
+	h.ctx = nil
+	if lines := h.LatestMetrics(); lines != nil {
+		t.Errorf("a cancelled run should not feed the sink: %+v", lines)
+	}
+
+	h.Store = &failingStore{}
+	if err := h.writeMetricsValues(io.Discard, p); err == nil {
+		t.Fatal("a run that fails to save should fail")
+	}
+	if lines := h.LatestMetrics(); lines != nil {
+		t.Errorf("a run that was not saved should not feed the sink: %+v", lines)
+	}
+
+	h.Store = nil
+	if err := h.Warmup(); err != nil {
+		t.Fatal(err)
+	}
+	if lines := h.LatestMetrics(); lines != nil {
+		t.Errorf("warmup should not feed the sink: %+v", lines)
+	}
+
+	advance(time.Minute)
+	if err := h.writeMetricsValues(io.Discard, p); err != nil {
+		t.Fatal(err)
+	}
+	if lines := h.LatestMetrics(); len(lines) != 1 {
+		t.Errorf("a successful run should feed the sink: %+v", lines)
+	}
+}
@@ -0,0 +1,79 @@
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"time"
+)
+
+// SSHConfig 远程采集使用的SSH连接配置
+type SSHConfig struct {
+	// Addr 远程主机地址，未指定端口时使用22
+	Addr string
+	User string
+	// Password 和 PrivateKey(PEM格式) 至少设置一个
+	Password   string
+	PrivateKey []byte
+	// HostKeyCallback 校验远程主机密钥，必须设置
+	HostKeyCallback ssh.HostKeyCallback
+	// Timeout 建立连接的超时时间，为0时不限制
+	Timeout time.Duration
+}
+
+func (cfg SSHConfig) clientConfig() (*ssh.ClientConfig, error) {
+	var auth []ssh.AuthMethod
+	if len(cfg.PrivateKey) > 0 {
+		signer, err := ssh.ParsePrivateKey(cfg.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if cfg.Password != "" {
+		auth = append(auth, ssh.Password(cfg.Password))
+	}
+	return &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            auth,
+		HostKeyCallback: cfg.HostKeyCallback,
+		Timeout:         cfg.Timeout,
+	}, nil
+}
+
+func (cfg SSHConfig) addr() string {
+	if _, _, err := net.SplitHostPort(cfg.Addr); err != nil {
+		return net.JoinHostPort(cfg.Addr, "22")
+	}
+	return cfg.Addr
+}
+
+// SSHCommandMetrics 通过SSH在远程主机上执行command，并使用parse解析其标准输出，
+// 用于在没有本地agent的主机上采集指标
+func SSHCommandMetrics(cfg SSHConfig, command string, parse func(io.Reader) (map[string]interface{}, error)) (map[string]interface{}, error) {
+	clientConfig, err := cfg.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := ssh.Dial("tcp", cfg.addr(), clientConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var stdout bytes.Buffer
+	session.Stdout = &stdout
+	err = session.Run(command)
+	if err != nil {
+		return nil, fmt.Errorf("ssh: run %q: %w", command, err)
+	}
+	return parse(&stdout)
+}
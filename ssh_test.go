@@ -0,0 +1,127 @@
+package plugin
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// startSSHServer starts an SSH server which answers every exec request with
+// output and returns its address and host key.
+func startSSHServer(t *testing.T, output string) (string, ssh.PublicKey) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "idpc" && string(pass) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("access denied")
+		},
+	}
+	config.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSHConn(conn, config, output)
+		}
+	}()
+	return ln.Addr().String(), signer.PublicKey()
+}
+
+func serveSSHConn(conn net.Conn, config *ssh.ServerConfig, output string) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer channel.Close()
+			for req := range requests {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(true, nil)
+				io.WriteString(channel, output)
+				status := make([]byte, 4)
+				binary.BigEndian.PutUint32(status, 0)
+				channel.SendRequest("exit-status", false, status)
+				return
+			}
+		}()
+	}
+}
+
+func parseKeyValues(r io.Reader) (map[string]interface{}, error) {
+	stat := make(map[string]interface{})
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, err
+		}
+		stat[fields[0]] = v
+	}
+	return stat, scanner.Err()
+}
+
+func TestSSHCommandMetrics(t *testing.T) {
+	addr, hostKey := startSSHServer(t, "load1 0.5\nload5 1.25\n")
+	cfg := SSHConfig{
+		Addr:            addr,
+		User:            "idpc",
+		Password:        "secret",
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+	}
+	stat, err := SSHCommandMetrics(cfg, "cat /proc/loadavg", parseKeyValues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat["load1"] != 0.5 || stat["load5"] != 1.25 {
+		t.Errorf("unexpected metrics: %v", stat)
+	}
+
+	cfg.Password = "wrong"
+	if _, err := SSHCommandMetrics(cfg, "cat /proc/loadavg", parseKeyValues); err == nil {
+		t.Error("expected authentication error")
+	}
+}
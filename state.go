@@ -0,0 +1,75 @@
+package plugin
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// StateCodec 状态文件的编码格式。
+// 保存时 PluginValues.Values 中已经包含 "_lastTime" 键(Unix秒)，
+// 解码时应根据该键设置 PluginValues.Timestamp
+type StateCodec interface {
+	Encode(w io.Writer, values PluginValues) error
+	Decode(r io.Reader) (PluginValues, error)
+}
+
+var (
+	// DefaultStateCodec 默认的状态文件格式，将所有值编码为一个JSON对象
+	DefaultStateCodec StateCodec = jsonStateCodec{}
+	// MackerelStateCodec 与 go-mackerel-plugin 兼容的状态文件格式，所有值均为浮点数，
+	// 用于从Mackerel插件迁移时继续使用已有的状态文件
+	MackerelStateCodec StateCodec = mackerelStateCodec{}
+)
+
+func (h *IdpcPlugin) stateCodec() StateCodec {
+	if h.StateCodec == nil {
+		return DefaultStateCodec
+	}
+	return h.StateCodec
+}
+
+type jsonStateCodec struct{}
+
+func (jsonStateCodec) Encode(w io.Writer, values PluginValues) error {
+	return json.NewEncoder(w).Encode(values.Values)
+}
+
+func (jsonStateCodec) Decode(r io.Reader) (values PluginValues, err error) {
+	err = json.NewDecoder(r).Decode(&values.Values)
+	if err != nil {
+		return
+	}
+	// 其他工具写入的状态文件中 "_lastTime" 也可能是 json.Number 或数字字符串
+	if v, ok := values.Values["_lastTime"]; ok {
+		if sec := int64(toFloat64(v)); sec > 0 {
+			values.Timestamp = time.Unix(sec, 0)
+		}
+	}
+	return
+}
+
+type mackerelStateCodec struct{}
+
+func (mackerelStateCodec) Encode(w io.Writer, values PluginValues) error {
+	stat := make(map[string]float64, len(values.Values))
+	for k, v := range values.Values {
+		stat[k] = toFloat64(v)
+	}
+	stat["_lastTime"] = float64(values.Timestamp.Unix())
+	return json.NewEncoder(w).Encode(stat)
+}
+
+func (mackerelStateCodec) Decode(r io.Reader) (values PluginValues, err error) {
+	var stat map[string]float64
+	err = json.NewDecoder(r).Decode(&stat)
+	if err != nil {
+		return
+	}
+	values.Values = make(map[string]interface{}, len(stat))
+	for k, v := range stat {
+		values.Values[k] = v
+	}
+	values.Timestamp = time.Unix(int64(stat["_lastTime"]), 0)
+	return
+}
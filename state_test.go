@@ -0,0 +1,222 @@
+package plugin
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// base64StateCodec wraps the default codec in base64.
+type base64StateCodec struct{}
+
+func (base64StateCodec) Encode(w io.Writer, values PluginValues) error {
+	enc := base64.NewEncoder(base64.StdEncoding, w)
+	if err := DefaultStateCodec.Encode(enc, values); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func (base64StateCodec) Decode(r io.Reader) (PluginValues, error) {
+	return DefaultStateCodec.Decode(base64.NewDecoder(base64.StdEncoding, r))
+}
+
+func TestStateCodecRoundTrip(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	h.StateCodec = base64StateCodec{}
+	now := time.Unix(1700000000, 0)
+	err := h.SaveValues(PluginValues{Values: map[string]interface{}{"value": 1.5}, Timestamp: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(h.TempFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "value") {
+		t.Errorf("state was not written with the custom codec: %s", b)
+	}
+	values, err := h.LoadLastValues()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values.Values["value"] != 1.5 || !values.Timestamp.Equal(now) {
+		t.Errorf("unexpected values after round trip: %+v", values)
+	}
+}
+
+func TestMackerelStateCodec(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	h.StateCodec = MackerelStateCodec
+	state := `{"cmd_get":12.5,".last_diff.cmd_get":3,"_lastTime":1700000000}`
+	if err := os.WriteFile(h.TempFile, []byte(state), 0644); err != nil {
+		t.Fatal(err)
+	}
+	values, err := h.LoadLastValues()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values.Values["cmd_get"] != 12.5 || values.Values[".last_diff.cmd_get"] != 3.0 ||
+		!values.Timestamp.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("unexpected values: %+v", values)
+	}
+
+	values.Values["cmd_set"] = uint64(7)
+	values.Timestamp = values.Timestamp.Add(time.Minute)
+	if err := h.SaveValues(values); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(h.TempFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{".last_diff.cmd_get":3,"_lastTime":1700000060,"cmd_get":12.5,"cmd_set":7}` + "\n"
+	if string(b) != want {
+		t.Errorf("state = %s, want %s", b, want)
+	}
+}
+
+// slowStateCodec simulates a state file on a hanging filesystem.
+type slowStateCodec struct {
+	delay time.Duration
+}
+
+func (c slowStateCodec) Encode(w io.Writer, values PluginValues) error {
+	time.Sleep(c.delay)
+	return DefaultStateCodec.Encode(w, values)
+}
+
+func (c slowStateCodec) Decode(r io.Reader) (PluginValues, error) {
+	time.Sleep(c.delay)
+	return DefaultStateCodec.Decode(r)
+}
+
+func TestStateIOTimeout(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	if err := h.SaveValues(PluginValues{Values: map[string]interface{}{"a": 1.0}, Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	h.StateCodec = slowStateCodec{delay: 200 * time.Millisecond}
+	h.StateIOTimeout = 5 * time.Second
+	if _, err := h.LoadLastValues(); err != nil {
+		t.Errorf("LoadLastValues within the timeout: %v", err)
+	}
+
+	h.StateCodec = slowStateCodec{delay: time.Second}
+	h.StateIOTimeout = 50 * time.Millisecond
+
+	start := time.Now()
+	if _, err := h.LoadLastValues(); err != errStateIOTimeout {
+		t.Errorf("LoadLastValues: expected a timeout, got %v", err)
+	}
+	if err := h.SaveValues(PluginValues{Values: map[string]interface{}{"a": 2.0}, Timestamp: time.Now()}); err != errStateIOTimeout {
+		t.Errorf("SaveValues: expected a timeout, got %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("state I/O should not block for %v", d)
+	}
+}
+
+// truncatingStateCodec writes part of the state and then fails, like a crash mid-write.
+type truncatingStateCodec struct{}
+
+func (truncatingStateCodec) Encode(w io.Writer, values PluginValues) error {
+	io.WriteString(w, `{"value":`)
+	return errors.New("disk full")
+}
+
+func (truncatingStateCodec) Decode(r io.Reader) (PluginValues, error) {
+	return DefaultStateCodec.Decode(r)
+}
+
+func TestSaveValuesAtomic(t *testing.T) {
+	dir := t.TempDir()
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	h.TempFile = filepath.Join(dir, "state")
+	now := time.Unix(1700000000, 0)
+	if err := h.SaveValues(PluginValues{Values: map[string]interface{}{"value": 1.5}, Timestamp: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	h.StateCodec = truncatingStateCodec{}
+	if err := h.SaveValues(PluginValues{Values: map[string]interface{}{"value": 2.5}, Timestamp: now.Add(time.Minute)}); err == nil {
+		t.Fatal("expected the interrupted save to fail")
+	}
+	values, err := h.LoadLastValues()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values.Values["value"] != 1.5 || !values.Timestamp.Equal(now) {
+		t.Errorf("the previous state should survive a failed save, got %+v", values)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != "state" && e.Name() != "state.lock" {
+			t.Errorf("unexpected file left behind: %s", e.Name())
+		}
+	}
+}
+
+func TestLoadLastValuesCorrupted(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	for _, content := range []string{"{not json", ""} {
+		if err := os.WriteFile(h.TempFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		values, err := h.LoadLastValues()
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", content, err)
+		}
+		if len(values.Values) != 0 || !values.Timestamp.IsZero() {
+			t.Errorf("%q: expected empty values, got %+v", content, values)
+		}
+	}
+
+	// a directory in place of the state file is an I/O error, not corruption
+	h.TempFile = t.TempDir()
+	if _, err := h.LoadLastValues(); err == nil {
+		t.Error("expected an error reading a directory")
+	}
+}
+
+func TestLoadLastValuesStringLastTime(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	for _, content := range []string{
+		`{"value":1,"_lastTime":"1700000000"}`,
+		`{"value":1,"_lastTime":1700000000}`,
+	} {
+		if err := os.WriteFile(h.TempFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		values, err := h.LoadLastValues()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !values.Timestamp.Equal(time.Unix(1700000000, 0)) {
+			t.Errorf("%s: timestamp = %v", content, values.Timestamp)
+		}
+	}
+
+	values, err := DefaultStateCodec.Decode(strings.NewReader(`{"_lastTime":"bogus"}`))
+	if err != nil || !values.Timestamp.IsZero() {
+		t.Errorf("invalid _lastTime: %v, %v", values.Timestamp, err)
+	}
+	if sec := int64(toFloat64(json.Number("1700000000"))); sec != 1700000000 {
+		t.Errorf("json.Number _lastTime = %d", sec)
+	}
+}
@@ -0,0 +1,105 @@
+package plugin
+
+import (
+	"bytes"
+	"github.com/rs/zerolog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// StateStore 保存两次采集之间的状态，用于计算Diff指标和判断元数据是否变化，见 IdpcPlugin.Store。
+// Save 的 PluginValues.Values 中已经包含 "_lastTime" 键(Unix秒)，
+// Load 返回最近一次保存的值和 Timestamp，没有保存过状态时返回空的 PluginValues 和nil
+type StateStore interface {
+	Load() (PluginValues, error)
+	Save(values PluginValues) error
+}
+
+// store 返回使用的 StateStore，未设置 Store 时使用 TempFile 状态文件
+func (h *IdpcPlugin) store() StateStore {
+	if h.Store != nil {
+		return h.Store
+	}
+	return fileStore{path: h.tempFilename(), codec: h.stateCodec(), logger: h.logger()}
+}
+
+// fileStore 默认的 StateStore，使用 StateCodec 编码保存在文件中
+type fileStore struct {
+	path   string
+	codec  StateCodec
+	logger *zerolog.Logger
+}
+
+// Load 文件不存在或无法解码时返回空数据
+func (s fileStore) Load() (PluginValues, error) {
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return PluginValues{}, nil
+		}
+		return PluginValues{}, err
+	}
+	values, err := s.codec.Decode(bytes.NewReader(b))
+	if err != nil {
+		// 状态文件损坏时与文件不存在相同，下次保存后恢复正常
+		s.logger.Debug().Err(err).Msgf("LoadLastValues: ignoring corrupted state file %s", s.path)
+		return PluginValues{}, nil
+	}
+	return values, nil
+}
+
+// Save 先写入同一目录下的临时文件再重命名为状态文件，
+// 写入失败或进程中途退出时原状态文件保持不变
+func (s fileStore) Save(values PluginValues) error {
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	err = s.codec.Encode(f, values)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+// MemoryStore 在内存中保存状态的 StateStore，用于测试和只在单个进程内运行的插件(如 ServeHTTP)，
+// 零值可以直接使用
+type MemoryStore struct {
+	mu     sync.Mutex
+	values PluginValues
+}
+
+// Load 返回最近一次保存的值的副本
+func (s *MemoryStore) Load() (PluginValues, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyValues(s.values), nil
+}
+
+// Save 保存values的副本
+func (s *MemoryStore) Save(values PluginValues) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values = copyValues(values)
+	return nil
+}
+
+func copyValues(values PluginValues) PluginValues {
+	if values.Values == nil {
+		return values
+	}
+	m := make(map[string]interface{}, len(values.Values))
+	for k, v := range values.Values {
+		m[k] = v
+	}
+	return PluginValues{Values: m, Timestamp: values.Timestamp}
+}
@@ -0,0 +1,63 @@
+package plugin
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := &MemoryStore{}
+	values, err := s.Load()
+	if err != nil || len(values.Values) != 0 || !values.Timestamp.IsZero() {
+		t.Fatalf("empty store: got %+v, %v", values, err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	saved := map[string]interface{}{"a": 1.0}
+	if err := s.Save(PluginValues{Values: saved, Timestamp: now}); err != nil {
+		t.Fatal(err)
+	}
+	saved["a"] = 2.0
+	values, _ = s.Load()
+	if values.Values["a"] != 1.0 || !values.Timestamp.Equal(now) {
+		t.Errorf("got %+v", values)
+	}
+	values.Values["a"] = 3.0
+	if values, _ = s.Load(); values.Values["a"] != 1.0 {
+		t.Errorf("Load should return a copy, got %+v", values)
+	}
+}
+
+func TestPluginStore(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"": {Metrics: []Metrics{{Name: "counter", Diff: true}}}},
+		values: map[string]interface{}{"counter": 100.0},
+	})
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	store := &MemoryStore{}
+	h.Store = store
+	last := PluginValues{Values: map[string]interface{}{"counter": 100.0}, Timestamp: time.Now().Add(-time.Minute)}
+	if err := store.Save(last); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := h.writeMetricsValues(buf, h.Plugin.(MetricsPlugin)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "test.counter\t0.000000\t") {
+		t.Errorf("diff should use the previous values from Store, got %q", buf.String())
+	}
+	values, _ := store.Load()
+	if values.Values["counter"] != 100.0 || values.Values["_lastTime"] == nil {
+		t.Errorf("values should be saved to Store, got %+v", values)
+	}
+	if _, err := os.Stat(h.TempFile); !os.IsNotExist(err) {
+		t.Errorf("state file should not be written when Store is set: %v", err)
+	}
+}
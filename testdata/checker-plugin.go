@@ -0,0 +1,38 @@
+package main
+
+import (
+	plugin "github.com/gorpher/go-idpc-plugin"
+	"os"
+	"runtime"
+)
+
+type checkerPlugin struct {
+	message string
+	status  plugin.Status
+}
+
+func (c checkerPlugin) Meta() plugin.Meta {
+	return plugin.Meta{
+		Key:       "test",
+		Type:      plugin.TypeChecker,
+		Version:   plugin.Version{Major: 1},
+		Revision:  "test",
+		GOOS:      runtime.GOOS,
+		GOARCH:    runtime.GOARCH,
+		GOVersion: runtime.Version(),
+	}
+}
+
+func (c checkerPlugin) Checker() (message string, status plugin.Status) {
+	return c.message, c.status
+}
+
+func main() {
+	flags := plugin.NewFlagSet(checkerPlugin{}.Meta())
+	status := flags.String("status", "OK", "check status")
+	message := flags.String("message", "", "check message")
+	flags.Parse(os.Args[1:])
+
+	helper := plugin.NewIdpcPlugin(checkerPlugin{message: *message, status: plugin.Status(*status)})
+	flags.Run(&helper)
+}
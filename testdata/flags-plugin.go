@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	plugin "github.com/gorpher/go-idpc-plugin"
+	"os"
+	"runtime"
+)
+
+type flagsPlugin struct {
+	addr string
+}
+
+func (p flagsPlugin) Meta() plugin.Meta {
+	return plugin.Meta{
+		Key:       "test",
+		Type:      plugin.TypeMetrics,
+		Version:   plugin.Version{Major: 1, Minor: 2, Patch: 3},
+		Revision:  "abc",
+		GOOS:      runtime.GOOS,
+		GOARCH:    runtime.GOARCH,
+		GOVersion: runtime.Version(),
+	}
+}
+
+func (p flagsPlugin) Metrics() (map[string]interface{}, error) {
+	return map[string]interface{}{"value": 1.0}, nil
+}
+
+func (p flagsPlugin) GraphDefinition() map[string]plugin.Graphs {
+	return map[string]plugin.Graphs{
+		"": {Unit: plugin.UnitFloat, Metrics: []plugin.Metrics{{Name: "value"}}},
+	}
+}
+
+func main() {
+	flags := plugin.NewFlagSet(flagsPlugin{}.Meta())
+	printAddr := flags.Bool("addr", false, "print the target address and exit")
+	redact := flags.Bool("redact", false, "redact the build information")
+	flags.Parse(os.Args[1:])
+
+	p := flagsPlugin{addr: flags.Addr("11211")}
+	if *printAddr {
+		fmt.Println(p.addr)
+		return
+	}
+	helper := plugin.NewIdpcPlugin(p)
+	helper.RedactVersion = *redact
+	flags.Run(&helper)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	plugin "github.com/gorpher/go-idpc-plugin"
+	"runtime"
+)
+
+var (
+	errUnreachable = errors.New("backend unreachable")
+	errBadConfig   = errors.New("bad config")
+)
+
+type metricsPlugin struct {
+	err error
+}
+
+func (m metricsPlugin) Meta() plugin.Meta {
+	return plugin.Meta{
+		Key:       "test",
+		Type:      plugin.TypeMetrics,
+		Version:   plugin.Version{Major: 1},
+		Revision:  "test",
+		GOOS:      runtime.GOOS,
+		GOARCH:    runtime.GOARCH,
+		GOVersion: runtime.Version(),
+	}
+}
+
+func (m metricsPlugin) Metrics() (map[string]interface{}, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return map[string]interface{}{"value": 1.0}, nil
+}
+
+func (m metricsPlugin) GraphDefinition() map[string]plugin.Graphs {
+	return map[string]plugin.Graphs{
+		"": {Unit: plugin.UnitFloat, Metrics: []plugin.Metrics{{Name: "value"}}},
+	}
+}
+
+func main() {
+	e := flag.String("error", "", "error returned by Metrics (unreachable, config or other)")
+	tempFile := flag.String("tempFile", "", "Temp file name")
+	flag.Parse()
+
+	var p metricsPlugin
+	switch *e {
+	case "unreachable":
+		p.err = fmt.Errorf("dial: %w", errUnreachable)
+	case "config":
+		p.err = errBadConfig
+	case "other":
+		p.err = errors.New("other")
+	}
+	helper := plugin.NewIdpcPlugin(p)
+	helper.TempFile = *tempFile
+	helper.ErrorExitCodes = []plugin.ErrorExitCode{
+		{Err: errUnreachable, Code: 3},
+		{Err: errBadConfig, Code: 4},
+	}
+	helper.Run()
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"fmt"
+	plugin "github.com/gorpher/go-idpc-plugin"
+	"os"
+	"runtime"
+)
+
+// prints the version line only for the argument in VERSION_ARG
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == os.Getenv("VERSION_ARG") {
+		fmt.Printf("%s-test-metrics version 1.2.3 (rev abc) [%s %s %s]\n", plugin.PLUGIN_PREFIX, runtime.GOOS, runtime.GOARCH, runtime.Version())
+		return
+	}
+	fmt.Fprintln(os.Stderr, "unknown argument")
+	os.Exit(2)
+}
@@ -0,0 +1,26 @@
+package plugin
+
+import "fmt"
+
+// CheckThreshold 按阈值判断value的状态：value >= crit 为CRITICAL，value >= warn 为WARNING，否则为OK。
+// warn > crit 时视为反向阈值(值越低越严重)：value <= crit 为CRITICAL，value <= warn 为WARNING
+func CheckThreshold(value, warn, crit float64) (Status, string) {
+	if warn > crit {
+		switch {
+		case value <= crit:
+			return StatusCritical, fmt.Sprintf("%g <= %g (critical)", value, crit)
+		case value <= warn:
+			return StatusWarning, fmt.Sprintf("%g <= %g (warning)", value, warn)
+		default:
+			return StatusOK, fmt.Sprintf("%g > %g", value, warn)
+		}
+	}
+	switch {
+	case value >= crit:
+		return StatusCritical, fmt.Sprintf("%g >= %g (critical)", value, crit)
+	case value >= warn:
+		return StatusWarning, fmt.Sprintf("%g >= %g (warning)", value, warn)
+	default:
+		return StatusOK, fmt.Sprintf("%g < %g", value, warn)
+	}
+}
@@ -0,0 +1,33 @@
+package plugin
+
+import "testing"
+
+func TestCheckThreshold(t *testing.T) {
+	for _, tc := range []struct {
+		value, warn, crit float64
+		status            Status
+		message           string
+	}{
+		// normal: high is bad
+		{10, 80, 90, StatusOK, "10 < 80"},
+		{85, 80, 90, StatusWarning, "85 >= 80 (warning)"},
+		{95, 80, 90, StatusCritical, "95 >= 90 (critical)"},
+		{80, 80, 90, StatusWarning, "80 >= 80 (warning)"},
+		{90, 80, 90, StatusCritical, "90 >= 90 (critical)"},
+		// inverted: low is bad
+		{50, 20, 10, StatusOK, "50 > 20"},
+		{15, 20, 10, StatusWarning, "15 <= 20 (warning)"},
+		{5, 20, 10, StatusCritical, "5 <= 10 (critical)"},
+		{20, 20, 10, StatusWarning, "20 <= 20 (warning)"},
+		{10, 20, 10, StatusCritical, "10 <= 10 (critical)"},
+		// warn == crit skips the warning band
+		{50, 50, 50, StatusCritical, "50 >= 50 (critical)"},
+		{49, 50, 50, StatusOK, "49 < 50"},
+	} {
+		status, message := CheckThreshold(tc.value, tc.warn, tc.crit)
+		if status != tc.status || message != tc.message {
+			t.Errorf("CheckThreshold(%g, %g, %g) = %s, %q, want %s, %q",
+				tc.value, tc.warn, tc.crit, status, message, tc.status, tc.message)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// versionArgs CheckPluginVersion 依次尝试的获取版本信息的参数
+var versionArgs = []string{"version", "-v", "--version"}
+
+// versionTimeout CheckPluginVersion 每次执行插件的超时时间
+const versionTimeout = 5 * time.Second
+
+// CheckPluginVersion 执行path指定的插件获取版本信息，依次尝试 version 子命令、-v 和 --version，
+// 返回第一个可以被 ParseVersionCommand 解析的结果
+func CheckPluginVersion(path string) (Meta, error) {
+	for _, arg := range versionArgs {
+		ctx, cancel := context.WithTimeout(context.Background(), versionTimeout)
+		out, _ := exec.CommandContext(ctx, path, arg).Output()
+		cancel()
+		if meta := ParseVersionCommand(string(out)); meta.Key != "" {
+			return meta, nil
+		}
+	}
+	return Meta{}, fmt.Errorf("%s: no version output for %v", path, versionArgs)
+}
@@ -0,0 +1,116 @@
+package plugin
+
+import (
+	"regexp"
+	"strings"
+)
+
+// isWildcard 判断指标定义是否使用通配符(* 或 #)匹配多个指标
+func isWildcard(prefix string, metric Metrics) bool {
+	return strings.ContainsAny(prefix+metric.Name, "*#")
+}
+
+// wildcardPattern 返回通配符指标匹配的完整名称模式，图表key为空时只使用指标名称
+func wildcardPattern(prefix string, metric Metrics) string {
+	if prefix == "" {
+		return metric.Name
+	}
+	return prefix + "." + metric.Name
+}
+
+// wildcardRegexp 返回通配符模式对应的正则表达式，编译结果被缓存
+func (h *IdpcPlugin) wildcardRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := h.wildcardRegexps[pattern]; ok {
+		return re, nil
+	}
+	regexpStr := `\A` + pattern
+	regexpStr = strings.Replace(regexpStr, ".", "\\.", -1)
+	regexpStr = strings.Replace(regexpStr, "*", "[-a-zA-Z0-9_]+", -1)
+	regexpStr = strings.Replace(regexpStr, "#", "[-a-zA-Z0-9_]+", -1)
+	re, err := regexp.Compile(regexpStr)
+	if err != nil {
+		return nil, err
+	}
+	if h.wildcardRegexps == nil {
+		h.wildcardRegexps = make(map[string]*regexp.Regexp)
+	}
+	h.wildcardRegexps[pattern] = re
+	return re, nil
+}
+
+// wildcardKeys 返回values中匹配通配符模式的key，优先使用本次采集的 wildcardIndex，
+// 模式无法编译为正则表达式时记录错误并跳过该指标
+func (h *IdpcPlugin) wildcardKeys(pattern string, values map[string]interface{}) []string {
+	if keys, ok := h.wildcardIndex[pattern]; ok {
+		return keys
+	}
+	re, err := h.wildcardRegexp(pattern)
+	if err != nil {
+		h.logger().Error().Err(err).Msgf("Invalid wildcard metric %s, skipped", pattern)
+		return nil
+	}
+	var keys []string
+	for k := range values {
+		if re.MatchString(k) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// firstSegment 返回名称中第一个 "." 之前的部分
+func firstSegment(name string) string {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// indexWildcards 遍历一次values，计算defs中每个通配符模式匹配的key。
+// 模式按第一段名称分组，每个key只与第一段相同的模式(以及第一段包含通配符的模式)比较，
+// 避免每个通配符指标都遍历整个values
+func (h *IdpcPlugin) indexWildcards(defs map[string]Graphs, values map[string]interface{}) map[string][]string {
+	type entry struct {
+		pattern string
+		re      *regexp.Regexp
+	}
+	buckets := make(map[string][]entry)
+	var generic []entry
+	index := make(map[string][]string)
+	for key, graph := range defs {
+		for _, metric := range graph.Metrics {
+			if !isWildcard(key, metric) {
+				continue
+			}
+			pattern := wildcardPattern(key, metric)
+			if _, ok := index[pattern]; ok {
+				continue
+			}
+			re, err := h.wildcardRegexp(pattern)
+			if err != nil {
+				// 留给 wildcardKeys 记录错误
+				continue
+			}
+			index[pattern] = nil
+			e := entry{pattern, re}
+			if seg := firstSegment(pattern); strings.ContainsAny(seg, "*#") {
+				generic = append(generic, e)
+			} else {
+				buckets[seg] = append(buckets[seg], e)
+			}
+		}
+	}
+	if len(index) == 0 {
+		return nil
+	}
+	for k := range values {
+		for _, entries := range [][]entry{buckets[firstSegment(k)], generic} {
+			for _, e := range entries {
+				if e.re.MatchString(k) {
+					index[e.pattern] = append(index[e.pattern], k)
+				}
+			}
+		}
+	}
+	return index
+}
@@ -0,0 +1,160 @@
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rs/zerolog"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestIndexWildcards(t *testing.T) {
+	defs := map[string]Graphs{
+		"disk":  {Metrics: []Metrics{{Name: "*.reads"}, {Name: "*.writes"}, {Name: "total"}}},
+		"net.#": {Metrics: []Metrics{{Name: "rx"}}},
+	}
+	values := map[string]interface{}{
+		"disk.sda.reads":  1.0,
+		"disk.sdb.reads":  1.0,
+		"disk.sda.writes": 1.0,
+		"disk.total":      1.0,
+		"net.eth0.rx":     1.0,
+		"net.eth0.tx":     1.0,
+	}
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	index := h.indexWildcards(defs, values)
+	for pattern, want := range map[string]string{
+		"disk.*.reads":  "disk.sda.reads,disk.sdb.reads",
+		"disk.*.writes": "disk.sda.writes",
+		"net.#.rx":      "net.eth0.rx",
+	} {
+		keys := index[pattern]
+		sort.Strings(keys)
+		if got := strings.Join(keys, ","); got != want {
+			t.Errorf("%s: got %s, want %s", pattern, got, want)
+		}
+	}
+	if len(index) != 3 {
+		t.Errorf("unexpected patterns %v", index)
+	}
+	for pattern, keys := range index {
+		if scanned := h.wildcardKeys(pattern, values); len(scanned) != len(keys) {
+			t.Errorf("%s: index %v differs from a full scan %v", pattern, keys, scanned)
+		}
+	}
+}
+
+func TestWildcardEmptyGraphKey(t *testing.T) {
+	h := NewIdpcPlugin(testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"": {Metrics: []Metrics{{Name: "*.requests"}}}},
+		values: map[string]interface{}{"api.requests": 1.0, "web.requests": 2.0, "api.errors": 3.0},
+	})
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	buf := &bytes.Buffer{}
+	if err := h.writeMetricsValues(buf, h.Plugin.(MetricsPlugin)); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	sort.Strings(lines)
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "test.api.requests\t1.000000\t") ||
+		!strings.HasPrefix(lines[1], "test.web.requests\t2.000000\t") {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestWildcardInvalidPattern(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := zerolog.New(buf)
+	h := NewIdpcPlugin(testMetricsPlugin{
+		key: "test",
+		graphs: map[string]Graphs{
+			"bad":  {Metrics: []Metrics{{Name: "*.(count"}}},
+			"disk": {Metrics: []Metrics{{Name: "*.reads"}}},
+		},
+		values: map[string]interface{}{"bad.x.(count": 1.0, "disk.sda.reads": 2.0},
+	})
+	h.Logger = &logger
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	out := &bytes.Buffer{}
+	if err := h.writeMetricsValues(out, h.Plugin.(MetricsPlugin)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "test.disk.sda.reads\t2.000000\t") || strings.Count(out.String(), "\n") != 1 {
+		t.Errorf("other metrics should still emit, got %q", out.String())
+	}
+	if !strings.Contains(buf.String(), `"level":"error"`) || !strings.Contains(buf.String(), "Invalid wildcard metric bad.*.(count") {
+		t.Errorf("expected an error log for the invalid pattern, got %q", buf.String())
+	}
+}
+
+// wildcardBenchmarkData returns graphs with one wildcard metric each and
+// the values they match.
+func wildcardBenchmarkData(graphs, devices int) (map[string]Graphs, map[string]interface{}) {
+	defs := make(map[string]Graphs, graphs)
+	values := make(map[string]interface{}, graphs*devices)
+	for i := 0; i < graphs; i++ {
+		key := fmt.Sprintf("disk%d", i)
+		defs[key] = Graphs{Metrics: []Metrics{{Name: "*.reads"}}}
+		for j := 0; j < devices; j++ {
+			values[fmt.Sprintf("%s.dev%d.reads", key, j)] = float64(j)
+		}
+	}
+	return defs, values
+}
+
+// perMetricWildcardKeys is the former formatValuesWithWildcard matching which
+// compiles a regexp and scans all values for every wildcard metric.
+func perMetricWildcardKeys(defs map[string]Graphs, values map[string]interface{}) int {
+	n := 0
+	for key, graph := range defs {
+		for _, metric := range graph.Metrics {
+			regexpStr := `\A` + key + "." + metric.Name
+			regexpStr = strings.Replace(regexpStr, ".", "\\.", -1)
+			regexpStr = strings.Replace(regexpStr, "*", "[-a-zA-Z0-9_]+", -1)
+			re := regexp.MustCompile(regexpStr)
+			for k := range values {
+				if re.MatchString(k) {
+					n++
+				}
+			}
+		}
+	}
+	return n
+}
+
+func BenchmarkWildcardPerMetric(b *testing.B) {
+	defs, values := wildcardBenchmarkData(200, 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		perMetricWildcardKeys(defs, values)
+	}
+}
+
+func BenchmarkWildcardIndexed(b *testing.B) {
+	defs, values := wildcardBenchmarkData(200, 100)
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.indexWildcards(defs, values)
+	}
+}
+
+func BenchmarkWildcardRegexpCompile(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+		h.wildcardRegexp("disk.*.reads")
+	}
+}
+
+func BenchmarkWildcardRegexpCached(b *testing.B) {
+	h := NewIdpcPlugin(testMetricsPlugin{key: "test"})
+	h.wildcardRegexp("disk.*.reads")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.wildcardRegexp("disk.*.reads")
+	}
+}
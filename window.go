@@ -0,0 +1,86 @@
+package plugin
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// windowPrefix 状态中保存指标最近 WindowSize 次原始值的键前缀
+const windowPrefix = ".window."
+
+// updateWindows 将本次采集的原始值追加到上次状态中的窗口，只保留最近size个值
+func updateWindows(last, current PluginValues, size int) {
+	windows := make(map[string][]interface{})
+	for k, v := range current.Values {
+		if strings.HasPrefix(k, ".") || strings.HasPrefix(k, "_") {
+			continue
+		}
+		f, ok := windowValue(v)
+		if !ok {
+			continue
+		}
+		window, _ := last.Values[windowPrefix+k].([]interface{})
+		window = append(append([]interface{}{}, window...), f)
+		if len(window) > size {
+			window = window[len(window)-size:]
+		}
+		windows[windowPrefix+k] = window
+	}
+	for k, window := range windows {
+		current.Values[k] = window
+	}
+}
+
+// windowValue 将原始值转换为窗口中保存的浮点数，无法转换时返回false
+func windowValue(value interface{}) (float64, bool) {
+	switch v := normalizeValue(value).(type) {
+	case uint32, uint64, int64, float64:
+		return toFloat64(v), true
+	case string:
+		var f float64
+		_, err := fmt.Sscan(v, &f)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// percentile 使用最近秩方法计算values的第p百分位数，p的取值范围为0到100
+func percentile(values []float64, p float64) float64 {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
+
+// CheckPercentile 读取状态中保存的指标name的值窗口(见 WindowSize)，
+// 第p百分位数超过threshold时返回CRITICAL，窗口为空时返回UNKNOWN
+func (h *IdpcPlugin) CheckPercentile(name string, p float64, threshold float64) CheckResult {
+	values, err := h.LoadLastValues()
+	if err != nil {
+		return CheckResult{Status: StatusUnknown, Message: fmt.Sprintf("load state: %v", err)}
+	}
+	window, _ := values.Values[windowPrefix+name].([]interface{})
+	samples := make([]float64, 0, len(window))
+	for _, v := range window {
+		if f, ok := v.(float64); ok {
+			samples = append(samples, f)
+		}
+	}
+	if len(samples) == 0 {
+		return CheckResult{Status: StatusUnknown, Message: fmt.Sprintf("no samples for %s", name)}
+	}
+	v := percentile(samples, p)
+	if v > threshold {
+		return CheckResult{Status: StatusCritical, Message: fmt.Sprintf("p%g of %s is %g (> %g, %d samples)", p, name, v, threshold, len(samples))}
+	}
+	return CheckResult{Status: StatusOK, Message: fmt.Sprintf("p%g of %s is %g (<= %g, %d samples)", p, name, v, threshold, len(samples))}
+}
@@ -0,0 +1,82 @@
+package plugin
+
+import (
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckPercentile(t *testing.T) {
+	values := map[string]interface{}{}
+	p := testMetricsPlugin{
+		key:    "test",
+		graphs: map[string]Graphs{"": {Metrics: []Metrics{{Name: "latency"}}}},
+		values: values,
+	}
+	h := NewIdpcPlugin(p)
+	h.TempFile = filepath.Join(t.TempDir(), "state")
+	h.WindowSize = 5
+	advance := testClock(&h)
+
+	for _, v := range []float64{500, 10, 20, 30, 40, 200} {
+		values["latency"] = v
+		advance(time.Minute)
+		if err := h.writeMetricsValues(io.Discard, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the window keeps the last 5 values: 10 20 30 40 200
+	if r := h.CheckPercentile("latency", 80, 50); r.Status != "OK" {
+		t.Errorf("p80 should be 40, got %+v", r)
+	}
+	if r := h.CheckPercentile("latency", 99, 50); r.Status != "CRITICAL" {
+		t.Errorf("p99 should be 200, got %+v", r)
+	}
+	if r := h.CheckPercentile("missing", 99, 50); r.Status != "UNKNOWN" {
+		t.Errorf("expected UNKNOWN for a metric without samples, got %+v", r)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	values := []float64{15, 20, 35, 40, 50}
+	for p, want := range map[float64]float64{0: 15, 30: 20, 40: 20, 50: 35, 100: 50} {
+		if got := percentile(values, p); got != want {
+			t.Errorf("percentile(%v) = %v, want %v", p, got, want)
+		}
+	}
+}
+
+func TestWindowValue(t *testing.T) {
+	for _, tc := range []struct {
+		value interface{}
+		want  float64
+		ok    bool
+	}{
+		{7, 7, true},
+		{int64(-3), -3, true},
+		{json.Number("42"), 42, true},
+		{json.Number("1.5"), 1.5, true},
+		{true, 1, true},
+		{1500 * time.Millisecond, 1.5, true},
+		{"2.5", 2.5, true},
+		{"n/a", 0, false},
+		{[]int{1}, 0, false},
+	} {
+		got, ok := windowValue(tc.value)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("windowValue(%T %v) = %v, %v, want %v, %v", tc.value, tc.value, got, ok, tc.want, tc.ok)
+		}
+	}
+
+	current := PluginValues{Values: map[string]interface{}{"int": 5, "number": json.Number("7")}}
+	updateWindows(PluginValues{}, current, 3)
+	for k, want := range map[string]float64{"int": 5, "number": 7} {
+		window, _ := current.Values[windowPrefix+k].([]interface{})
+		if len(window) != 1 || window[0] != want {
+			t.Errorf("window of %s = %v, want [%v]", k, window, want)
+		}
+	}
+}